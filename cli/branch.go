@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"flag"
+	"os"
+)
+
+type BranchFlags struct {
+	Branch       string
+	Merge        bool
+	ValidatePath string
+}
+
+func (b *BranchFlags) SetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&b.Branch, "branch", "", "Zed branch to write to, created from main if missing (default main)")
+	fs.BoolVar(&b.Merge, "merge", false, "when done, validate the branch, merge it into main, and remove it")
+	fs.StringVar(&b.ValidatePath, "validate", "", "path of Zed query run on the branch before merging (any value returned fails validation)")
+}
+
+// LoadValidate returns the validation query or an empty string if none
+// was specified.
+func (b *BranchFlags) LoadValidate() (string, error) {
+	if b.ValidatePath == "" {
+		return "", nil
+	}
+	buf, err := os.ReadFile(b.ValidatePath)
+	return string(buf), err
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/pkg/units"
+	"github.com/brimdata/zync/etl"
+)
+
+type CreateFlags struct {
+	Create  bool
+	OrderBy string
+	Thresh  units.Bytes
+}
+
+func (c *CreateFlags) SetFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Create, "create", false, "create missing pools")
+	fs.StringVar(&c.OrderBy, "create.orderby", "kafka.offset:asc", "pool key of created pools (overridden by orderby in a route)")
+	fs.Var(&c.Thresh, "create.thresh", "target data object size of created pools, e.g., 500MB (overridden by thresh in a route; default lake default)")
+}
+
+// CreatePool creates the pool of route if it is missing and creation was
+// requested.  The route's orderby and thresh, if set, take precedence over
+// the flags.
+func (c *CreateFlags) CreatePool(ctx context.Context, service lakeapi.Interface, route etl.Route) error {
+	if !c.Create {
+		return nil
+	}
+	orderBy := c.OrderBy
+	if route.OrderBy != "" {
+		orderBy = route.OrderBy
+	}
+	thresh := c.Thresh
+	if route.Thresh != "" {
+		if err := thresh.Set(route.Thresh); err != nil {
+			return fmt.Errorf("pool %s: bad thresh %q: %w", route.Pool, route.Thresh, err)
+		}
+	}
+	created, err := etl.CreatePool(ctx, service, route.Pool, orderBy, int64(thresh))
+	if err != nil {
+		return fmt.Errorf("pool %s: %w", route.Pool, err)
+	}
+	if created {
+		fmt.Printf("created pool %s with pool key %s\n", route.Pool, orderBy)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	lakeapi "github.com/brimdata/zed/lake/api"
+)
+
+type LeaseFlags struct {
+	TTL  time.Duration
+	Wait bool
+}
+
+func (l *LeaseFlags) SetFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&l.TTL, "lease.ttl", 30*time.Second, "duration of writer leases (0 disables writer fencing)")
+	fs.BoolVar(&l.Wait, "lease.wait", false, "wait for another writer's lease to expire instead of exiting")
+}
+
+// Check disables leases, with a warning, for a lake reached through a lake
+// service, since leases are kept in commits without data, which only direct
+// access to the lake can make.
+func (l *LeaseFlags) Check(service lakeapi.Interface) {
+	if l.TTL > 0 && service.Root() == nil {
+		fmt.Fprintln(os.Stderr, "warning: writer leases need direct access to the lake and are disabled for a lake service, so make sure only one writer syncs each topic; set -lake or ZED_LAKE to the lake's path to use leases")
+		l.TTL = 0
+	}
+}
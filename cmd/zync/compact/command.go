@@ -0,0 +1,76 @@
+package compact
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"syscall"
+
+	"github.com/brimdata/zed/pkg/charm"
+	"github.com/brimdata/zync/cli"
+	"github.com/brimdata/zync/cmd/zync/root"
+	"github.com/brimdata/zync/etl"
+	"github.com/segmentio/ksuid"
+)
+
+var Spec = &charm.Spec{
+	Name:  "compact",
+	Usage: "compact [options] pool ...",
+	Short: "merge small data objects of Zed lake pools",
+	Long: `
+The "compact" command merges the data objects of each pool that are smaller
+than the pool's target object size into larger objects in pool key order.
+Frequent commits by "zync from-kafka" with a short -interval create many
+small objects, which degrade query performance.  (from-kafka can also
+compact its pools periodically with -compact.)
+
+Compaction does not change what queries of the pool return.  The compaction
+commit records the pool's checkpoint, so "zync from-kafka" resumes syncing
+from the same offsets as before.  If another writer commits to a pool while
+it is being compacted, the pool is compacted again from its new head.
+`,
+	New: New,
+}
+
+func init() {
+	root.Zync.Add(Spec)
+}
+
+type Command struct {
+	*root.Command
+	lakeFlags cli.LakeFlags
+	branch    string
+}
+
+func New(parent charm.Command, fs *flag.FlagSet) (charm.Command, error) {
+	c := &Command{Command: parent.(*root.Command)}
+	fs.StringVar(&c.branch, "branch", "main", "Zed branch to compact")
+	c.lakeFlags.SetFlags(fs)
+	return c, nil
+}
+
+func (c *Command) Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no pool provided")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	lake, err := c.lakeFlags.Open(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pool := range args {
+		commit, n, err := etl.Compact(ctx, lake, pool, c.branch)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pool, err)
+		}
+		if commit == ksuid.Nil {
+			fmt.Printf("pool %s has nothing to compact\n", pool)
+			continue
+		}
+		fmt.Printf("pool %s compacted %d objects in commit %s\n", pool, n, commit)
+	}
+	return nil
+}
@@ -8,11 +8,13 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/brimdata/zed/pkg/charm"
 	"github.com/brimdata/zync/cli"
 	"github.com/brimdata/zync/cmd/zync/root"
 	"github.com/brimdata/zync/etl"
+	"github.com/segmentio/ksuid"
 )
 
 var Spec = &charm.Spec{
@@ -23,7 +25,42 @@ var Spec = &charm.Spec{
 The "etl" command reads data from input pools, transforms it, and
 writes it to output pools according to config.yaml.
 
-All data pool keys must be "kafka.offset" sorted in ascending order.
+The data pools are best sorted by the pool key "kafka.offset" in ascending
+order.  Other pool keys work but require sorting the records read from
+the pools.
+
+The output is written to the main branch of the output pool unless
+a branch is given by -branch or by the output section of config.yaml.
+A branch other than main is created from main if it does not exist.
+With -merge, once the transform is done, the branch is validated by running
+the Zed query in the -validate file against it, and if the query returns
+no values, main is fast-forwarded to the branch in a single atomic step.
+The branch is then removed whether the merge succeeds or not, as it is if the
+transform fails.  The merge fails if main has changed since the branch
+was created.
+
+With -follow, etl keeps running after the transform is done, running it
+again whenever the branch of any input pool gets a new commit, until it is
+interrupted or, if -exitafter is set, until that duration has elapsed.  Runs
+start at least -interval apart, plus a random delay of up to -jitter, so
+several processes following the same pools do not run in step.  Each run
+is reported with the number of records transformed and its duration.  An
+interrupted run commits nothing.  A failed run is reported and retried after
+a wait that doubles with each failure in a row, up to a minute.  A commit
+made by etl itself to an input branch that is also its output branch does not
+start another run.  With -merge, -follow requires -exitafter,
+and the branch is merged into main once etl exits.
+
+With -check, etl checks config.yaml without running the transform and
+reports each problem with its line in config.yaml: keys etl does not know,
+which otherwise keep etl from starting; transforms with missing or
+conflicting topics or with output topics outside the output pool; and
+where, zed, and other Zed snippets that do not parse.  It exits with an
+error if any are found.
+
+With -create, missing input and output pools are created with the pool key
+and target data object size given by the orderby and thresh fields of their
+routes in config.yaml or else by -create.orderby and -create.thresh.
 
 See https://github.com/brimdata/zync/README.md for a description
 of how this works.
@@ -37,14 +74,28 @@ func init() {
 
 type Command struct {
 	*root.Command
-	zed       bool
-	flags     cli.Flags
-	lakeFlags cli.LakeFlags
+	check       bool
+	zed         bool
+	exitAfter   time.Duration
+	follow      bool
+	interval    time.Duration
+	jitter      time.Duration
+	branchFlags cli.BranchFlags
+	createFlags cli.CreateFlags
+	flags       cli.Flags
+	lakeFlags   cli.LakeFlags
 }
 
 func New(parent charm.Command, fs *flag.FlagSet) (charm.Command, error) {
 	c := &Command{Command: parent.(*root.Command)}
+	fs.BoolVar(&c.check, "check", false, "check config.yaml for errors and exit")
 	fs.BoolVar(&c.zed, "zed", false, "dump compiled Zed to stdout and exit)")
+	fs.DurationVar(&c.exitAfter, "exitafter", 0, "with -follow, if >0, exit after this duration")
+	fs.BoolVar(&c.follow, "follow", false, "after the transform, keep running it on new commits to the input pools")
+	fs.DurationVar(&c.interval, "interval", time.Second, "with -follow, minimum interval between runs")
+	fs.DurationVar(&c.jitter, "jitter", 0, "with -follow, maximum random delay added to -interval")
+	c.branchFlags.SetFlags(fs)
+	c.createFlags.SetFlags(fs)
 	c.flags.SetFlags(fs)
 	c.lakeFlags.SetFlags(fs)
 	return c, nil
@@ -57,10 +108,40 @@ func (c *Command) Run(args []string) error {
 	if len(args) > 1 {
 		return errors.New("too many arguments")
 	}
+	if c.check {
+		problems, err := etl.Check(args[0])
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			if p.Line > 0 {
+				fmt.Printf("%s:%d: %s\n", args[0], p.Line, p.Err)
+			} else {
+				fmt.Printf("%s: %s\n", args[0], p.Err)
+			}
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problem%s found", len(problems), plural(len(problems)))
+		}
+		return nil
+	}
 	config, err := etl.Load(args[0])
 	if err != nil {
 		return err
 	}
+	if c.branchFlags.Branch != "" {
+		config.Output.Branch = c.branchFlags.Branch
+	}
+	if c.branchFlags.Merge && (config.Output.Branch == "" || config.Output.Branch == "main") {
+		return errors.New("-merge requires an output branch other than main")
+	}
+	if c.branchFlags.Merge && c.follow && c.exitAfter == 0 {
+		return errors.New("-merge with -follow requires -exitafter")
+	}
+	validate, err := c.branchFlags.LoadValidate()
+	if err != nil {
+		return err
+	}
 	if c.zed {
 		zeds, err := etl.Build(config)
 		if err != nil {
@@ -69,24 +150,57 @@ func (c *Command) Run(args []string) error {
 		fmt.Println(strings.Join(zeds, "\n===\n"))
 		return nil
 	}
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 	lake, err := c.lakeFlags.Open(ctx)
 	if err != nil {
 		return err
 	}
+	for _, route := range append(config.Inputs, config.Output) {
+		if err := c.createFlags.CreatePool(ctx, lake, route); err != nil {
+			return err
+		}
+	}
 	pipeline, err := etl.NewPipeline(ctx, config, lake)
 	if err != nil {
 		return err
 	}
-	n, err := pipeline.Run(ctx)
+	if c.follow {
+		runCtx := ctx
+		if c.exitAfter > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(ctx, c.exitAfter)
+			defer cancel()
+		}
+		opts := etl.FollowOptions{Interval: c.interval, Jitter: c.jitter}
+		err = pipeline.Follow(runCtx, opts, func(stats etl.Stats) {
+			fmt.Printf("run %d ETL'd %d record%s in %s (%d total)\n", stats.Run, stats.Records, plural(stats.Records), stats.Duration.Round(time.Millisecond), stats.Total)
+		})
+	} else {
+		var n int
+		n, err = pipeline.Run(ctx)
+		if err == nil {
+			if n != 0 {
+				fmt.Printf("ETL'd %d record%s\n", n, plural(n))
+			} else {
+				fmt.Println("nothing new found to ETL")
+			}
+		}
+	}
 	if err != nil {
+		if c.branchFlags.Merge {
+			pipeline.Discard(context.WithoutCancel(ctx))
+		}
 		return err
 	}
-	if n != 0 {
-		fmt.Printf("ETL'd %d record%s\n", n, plural(n))
-	} else {
-		fmt.Println("nothing new found to ETL")
+	if c.branchFlags.Merge {
+		commit, err := pipeline.Merge(ctx, validate)
+		if err != nil {
+			return err
+		}
+		if commit != ksuid.Nil {
+			fmt.Printf("merged branch %s into main as commit %s\n", config.Output.Branch, commit)
+		}
 	}
 	return nil
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/brimdata/zync/etl"
 	"github.com/brimdata/zync/fifo"
 	"github.com/riferrei/srclient"
+	"github.com/segmentio/ksuid"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sync/errgroup"
@@ -39,9 +40,46 @@ The "from-kafka" command syncs data from Kafka topics to Zed lake pools.
 Topics and their target pools are read from the inputs section of the
 config.yaml files.  (One topic/pool pair may also be specified via -topic
 and -pool.)  The Kafka records are transcoded into Zed and synced to the
-main branch of the target pools.
+main branch of the target pools or to the branch given by -branch or by
+the inputs section of config.yaml.  A branch other than main is created
+from main if it does not exist.
 
-The key for each pool must be "kafka.offset" in ascending order.
+With -merge and -exitafter, once from-kafka is done, each branch is validated
+by running the Zed query in the -validate file against it, and if the query
+returns no values, main is fast-forwarded to the branch in a single atomic
+step.  The branch is then removed whether the merge succeeds or not, as it is
+if syncing fails.  The merge fails if main has changed since the branch
+was created.
+
+With -create, missing pools are created with the pool key and target data
+object size given by the orderby and thresh fields of the pool's first
+input route or else by -create.orderby and -create.thresh.
+
+With -compact, the small data objects created by frequent commits are
+merged into larger ones at the given interval so query performance does not
+degrade.  Compaction does not change what queries return or where syncing
+resumes.
+
+Records are committed to each pool in batches of at most -thresh records
+and -threshbytes bytes, and a batch is committed no later than -interval
+after its first record is received.  Each pool has its own queue of received
+records.  When a queue holds more than -poolmaxbytes bytes, fetching from
+the pool's topics is paused until the queue drains so a slow pool does not
+hold up other pools.
+
+The pools may have any pool key.  from-kafka finds where to resume syncing
+each topic from the checkpoint recorded in the metadata of the pool's
+latest commit.
+
+Only a single writer is allowed at any given time to each topic in a pool.
+This is enforced with a lease for the topic, which is kept on the
+"zync-leases" branch of the pool and renewed every third of -lease.ttl.
+If the lease is held by another process, from-kafka exits or, with -lease.wait,
+waits for the lease to expire.  The holder of the lease is also recorded in
+the checkpoint of the pool, and each commit fails if the checkpoint it is
+based on names another holder, so a process that lost its lease cannot
+commit again.  Setting -lease.ttl to 0 disables leases, as does a lake
+reached through a lake service rather than by its path.
 
 See https://github.com/brimdata/zync/README.md for a description
 of how this works.
@@ -52,31 +90,43 @@ of how this works.
 type From struct {
 	*root.Command
 
+	branchFlags cli.BranchFlags
+	createFlags cli.CreateFlags
 	flags       cli.Flags
 	lakeFlags   cli.LakeFlags
+	leaseFlags  cli.LeaseFlags
 	shaperFlags cli.ShaperFlags
 
+	compact       time.Duration
 	exitAfter     time.Duration
 	kafkaLogLevel int
 	kafkaReplicas int
 	pool          string
+	poolMaxBytes  int
 	pprof         string
 	thresh        int
+	threshBytes   int
 	topicMaxBytes int
 	interval      time.Duration
 }
 
 func NewFrom(parent charm.Command, fs *flag.FlagSet) (charm.Command, error) {
 	f := &From{Command: parent.(*root.Command)}
+	f.branchFlags.SetFlags(fs)
+	f.createFlags.SetFlags(fs)
 	f.flags.SetFlags(fs)
 	f.lakeFlags.SetFlags(fs)
+	f.leaseFlags.SetFlags(fs)
 	f.shaperFlags.SetFlags(fs)
+	fs.DurationVar(&f.compact, "compact", 0, "if >0, compact small data objects of each pool at this interval")
 	fs.DurationVar(&f.exitAfter, "exitafter", 0, "if >0, exit after this duration")
 	fs.IntVar(&f.kafkaLogLevel, "kafka.loglevel", 0, "Kafka log level (0=none, 1=error, 2=warn, 3=info, 4=debug)")
 	fs.IntVar(&f.kafkaReplicas, "kafka.replicas", 0, "if >0, create Kafka topics with 1 partition and this replication factor")
 	fs.StringVar(&f.pool, "pool", "", "name of Zed pool")
+	fs.IntVar(&f.poolMaxBytes, "poolmaxbytes", 64*1024*1024, "maximum bytes queued per pool before pausing its topics")
 	fs.StringVar(&f.pprof, "pprof", "", "listen address for /debug/pprof/ HTTP server")
 	fs.IntVar(&f.thresh, "thresh", 1024*1024, "maximum number of records per commit")
+	fs.IntVar(&f.threshBytes, "threshbytes", 128*1024*1024, "maximum bytes per commit")
 	fs.IntVar(&f.topicMaxBytes, "topicmaxbytes", 1024*1024, "maximum bytes buffered per topic")
 	fs.DurationVar(&f.interval, "interval", 5*time.Second,
 		"maximum interval between receiving and committing a record")
@@ -91,11 +141,14 @@ func (f *From) Run(args []string) error {
 	}
 
 	poolToTopics := map[string]map[string]struct{}{}
+	poolToBranch := map[string]string{}
+	poolToRoute := map[string]etl.Route{}
 	if f.pool != "" || f.flags.Topic != "" {
 		if f.pool == "" || f.flags.Topic == "" {
 			return errors.New("both -pool and -topic must be set")
 		}
 		poolToTopics[f.pool] = map[string]struct{}{f.flags.Topic: {}}
+		poolToRoute[f.pool] = etl.Route{Topic: f.flags.Topic, Pool: f.pool}
 	}
 	for _, a := range args {
 		transform, err := etl.Load(a)
@@ -109,6 +162,13 @@ func (f *From) Run(args []string) error {
 				poolToTopics[i.Pool] = topics
 			}
 			topics[i.Topic] = struct{}{}
+			if branch, ok := poolToBranch[i.Pool]; ok && branch != i.Branch {
+				return fmt.Errorf("%s: pool %s has inputs on branches %q and %q", a, i.Pool, branch, i.Branch)
+			}
+			poolToBranch[i.Pool] = i.Branch
+			if _, ok := poolToRoute[i.Pool]; !ok {
+				poolToRoute[i.Pool] = i
+			}
 		}
 	}
 	if len(poolToTopics) == 0 {
@@ -117,6 +177,25 @@ func (f *From) Run(args []string) error {
 		}
 		return errors.New("provide YAML config files or set -pool and -topic")
 	}
+	if f.branchFlags.Branch != "" {
+		for pool := range poolToTopics {
+			poolToBranch[pool] = f.branchFlags.Branch
+		}
+	}
+	if f.branchFlags.Merge {
+		if f.exitAfter == 0 {
+			return errors.New("-merge requires -exitafter")
+		}
+		for pool := range poolToTopics {
+			if branch := poolToBranch[pool]; branch == "" || branch == "main" {
+				return fmt.Errorf("-merge requires a branch other than main for pool %s", pool)
+			}
+		}
+	}
+	validate, err := f.branchFlags.LoadValidate()
+	if err != nil {
+		return err
+	}
 
 	shaper, err := f.shaperFlags.Load()
 	if err != nil {
@@ -146,10 +225,12 @@ func (f *From) Run(args []string) error {
 	if err != nil {
 		return err
 	}
+	f.leaseFlags.Check(lake)
 
 	var fifoLakes []*fifo.Lake
-	var fifoLakeChs []<-chan zed.Value
-	topicToChs := map[string][]chan<- zed.Value{}
+	var fifoLakeTopics [][]string
+	var leases []*fifo.Lease
+	defer func() { fifo.ReleaseAll(context.Background(), leases) }()
 	topicToOffset := map[string]int64{}
 
 	group, groupCtx := errgroup.WithContext(ctx)
@@ -157,22 +238,49 @@ func (f *From) Run(args []string) error {
 	for pool, topics := range poolToTopics {
 		pool, topics := pool, topics
 		group.Go(func() error {
+			if err := f.createFlags.CreatePool(groupCtx, lake, poolToRoute[pool]); err != nil {
+				return err
+			}
 			fifoLake, err := fifo.NewLake(groupCtx, pool, "", lake)
 			if err != nil {
 				return fmt.Errorf("pool %s: %w", pool, err)
 			}
-			ch := make(chan zed.Value)
+			if branch := poolToBranch[pool]; branch != "" {
+				if err := fifoLake.UseBranch(groupCtx, branch); err != nil {
+					return fmt.Errorf("pool %s: %w", pool, err)
+				}
+			}
 			mu.Lock()
 			fifoLakes = append(fifoLakes, fifoLake)
-			fifoLakeChs = append(fifoLakeChs, ch)
+			fifoLakeTopics = append(fifoLakeTopics, maps.Keys(topics))
 			mu.Unlock()
+			if f.leaseFlags.TTL > 0 {
+				// Hold the leases before reading offsets so no
+				// other writer can advance them.
+				for t := range topics {
+					lease := fifo.NewLease(fifoLake, "from-kafka/"+t, f.leaseFlags.TTL)
+					if err := lease.Acquire(groupCtx, f.leaseFlags.Wait); err != nil {
+						return err
+					}
+					mu.Lock()
+					leases = append(leases, lease)
+					mu.Unlock()
+					if err := fifoLake.RequireLease(groupCtx, lease); err != nil {
+						return fmt.Errorf("pool %s: %w", pool, err)
+					}
+				}
+			}
+			// Offsets are read as of the head commit, which
+			// LoadBatch then requires to be unchanged.
+			if err := fifoLake.Rebase(groupCtx); err != nil {
+				return fmt.Errorf("pool %s: %w", pool, err)
+			}
 			for t := range topics {
 				offset, err := fifoLake.NextConsumerOffset(groupCtx, t)
 				if err != nil {
 					return fmt.Errorf("pool %s, topic %s: %w", pool, t, err)
 				}
 				mu.Lock()
-				topicToChs[t] = append(topicToChs[t], ch)
 				topicToOffset[t] = offset
 				mu.Unlock()
 			}
@@ -183,39 +291,79 @@ func (f *From) Run(args []string) error {
 		return err
 	}
 
-	group, ctx = errgroup.WithContext(ctx)
-	if f.kafkaReplicas > 0 {
-		group.Go(func() error {
-			return fifo.CreateMissingTopics(ctx, config, 1, int16(f.kafkaReplicas), nil, maps.Keys(topicToChs)...)
-		})
+	zctx := zed.NewContext()
+	consumer, err := fifo.NewConsumer(zctx, config, registry, f.flags.Format, topicToOffset, true)
+	if err != nil {
+		return err
 	}
-	timeoutCtx := ctx
-	if f.exitAfter > 0 {
-		timeoutCtx, cancel = context.WithTimeout(ctx, f.exitAfter)
-		defer cancel()
+	flow := newFlow(consumer)
+	topicToQueues := map[string][]*queue{}
+	var queues []*queue
+	for i := range fifoLakes {
+		q := newQueue(flow, f.poolMaxBytes, fifoLakeTopics[i])
+		queues = append(queues, q)
+		for _, t := range fifoLakeTopics[i] {
+			topicToQueues[t] = append(topicToQueues[t], q)
+		}
 	}
-	zctx := zed.NewContext()
-	for i, fifoLake := range fifoLakes {
-		fifoLake := fifoLake
-		ch := fifoLakeChs[i]
+
+	err = fifo.Fence(ctx, leases, func(ctx context.Context) error {
+		group, ctx := errgroup.WithContext(ctx)
+		if f.kafkaReplicas > 0 {
+			group.Go(func() error {
+				return fifo.CreateMissingTopics(ctx, config, 1, int16(f.kafkaReplicas), nil, maps.Keys(topicToOffset)...)
+			})
+		}
+		timeoutCtx := ctx
+		if f.exitAfter > 0 {
+			var cancel context.CancelFunc
+			timeoutCtx, cancel = context.WithTimeout(ctx, f.exitAfter)
+			defer cancel()
+		}
+		for i, fifoLake := range fifoLakes {
+			fifoLake := fifoLake
+			q := queues[i]
+			group.Go(func() error {
+				if err := f.runLoad(ctx, timeoutCtx, zctx, fifoLake, shaper, q); err != nil {
+					return fmt.Errorf("pool %s: %w", fifoLake.Pool(), err)
+				}
+				return nil
+			})
+		}
 		group.Go(func() error {
-			if err := f.runLoad(ctx, timeoutCtx, zctx, fifoLake, shaper, ch); err != nil {
-				return fmt.Errorf("pool %s: %w", fifoLake.Pool(), err)
-			}
-			return nil
+			return f.runRead(timeoutCtx, consumer, topicToQueues)
 		})
+		return group.Wait()
+	})
+	if !f.branchFlags.Merge {
+		return err
 	}
-	group.Go(func() error {
-		consumer, err := fifo.NewConsumer(zctx, config, registry, f.flags.Format, topicToOffset, true)
-		if err != nil {
-			return err
+	if err != nil {
+		for _, fifoLake := range fifoLakes {
+			fifoLake.Discard(context.WithoutCancel(ctx))
 		}
-		return f.runRead(timeoutCtx, consumer, topicToChs)
-	})
-	return group.Wait()
+		return err
+	}
+	// Merge each pool even if another fails so no branch is left behind.
+	for _, fifoLake := range fifoLakes {
+		branch := fifoLake.Branch()
+		commit, mergeErr := fifoLake.Merge(ctx, validate)
+		if mergeErr != nil {
+			if err == nil {
+				err = fmt.Errorf("pool %s: %w", fifoLake.Pool(), mergeErr)
+			}
+			continue
+		}
+		if commit != ksuid.Nil {
+			fmt.Printf("pool %s merged branch %s into main as commit %s\n", fifoLake.Pool(), branch, commit)
+		}
+	}
+	return err
 }
 
-func (f *From) runRead(ctx context.Context, c *fifo.Consumer, topicToChs map[string][]chan<- zed.Value) error {
+// runRead reads values from c and pushes each onto the queue of every pool
+// that syncs its topic.
+func (f *From) runRead(ctx context.Context, c *fifo.Consumer, topicToQueues map[string][]*queue) error {
 	for {
 		val, err := c.ReadValue(ctx)
 		if err != nil {
@@ -234,61 +382,97 @@ func (f *From) runRead(ctx context.Context, c *fifo.Consumer, topicToChs map[str
 		if err != nil {
 			return err
 		}
-		for _, ch := range topicToChs[topic] {
-			select {
-			case ch <- val:
-			case <-ctx.Done():
-			}
+		for _, q := range topicToQueues[topic] {
+			q.push(val)
 		}
 	}
 }
 
-func (f *From) runLoad(ctx, timeoutCtx context.Context, zctx *zed.Context, fifoLake *fifo.Lake, shaper string, ch <-chan zed.Value) error {
+func (f *From) runLoad(ctx, timeoutCtx context.Context, zctx *zed.Context, fifoLake *fifo.Lake, shaper string, q *queue) error {
 	ticker := time.NewTicker(f.interval)
 	defer ticker.Stop()
 	// Stop ticker until data arrives.
 	ticker.Stop()
+	var compact <-chan time.Time
+	if f.compact > 0 {
+		compactTicker := time.NewTicker(f.compact)
+		defer compactTicker.Stop()
+		compact = compactTicker.C
+	}
 	a := &zbuf.Array{}
+	var size int
+	// fill moves values from q to a until q is empty or a is full
+	// and returns true if a is full.
+	fill := func() bool {
+		var full bool
+		size, full = q.fill(a, size, f.thresh, f.threshBytes)
+		return full
+	}
 	for {
 		select {
-		case val := <-ch:
-			a.Append(val)
-			if n := len(a.Values()); n < f.thresh {
-				if n == 1 {
+		case <-q.ready:
+			wasEmpty := len(a.Values()) == 0
+			if !fill() {
+				if wasEmpty && len(a.Values()) > 0 {
 					// Start ticker.
 					ticker.Reset(f.interval)
 				}
 				continue
 			}
+			// Come back for whatever remains in the queue.
+			q.signal()
 		case <-ticker.C:
 			if len(a.Values()) == 0 {
 				continue
 			}
+		case <-compact:
+			// Compacting here keeps compaction commits from
+			// conflicting with this pool's loads.
+			commit, n, err := fifoLake.Compact(ctx)
+			if err != nil {
+				return err
+			}
+			if commit != ksuid.Nil {
+				fmt.Printf("pool %s compacted %d objects in commit %s\n", fifoLake.Pool(), n, commit)
+			}
+			continue
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-timeoutCtx.Done():
+			// Commit whatever remains in the queue before exiting.
+			fill()
 			if len(a.Values()) == 0 {
 				return nil
 			}
 		}
+		size = 0
 		// Stop ticker until more data arrives.
 		ticker.Stop()
+		batch := a
+		a = &zbuf.Array{}
+		// Track offsets before shaping since the shaper may drop records.
+		gaps, err := fifoLake.TrackOffsets(batch)
+		if err != nil {
+			return err
+		}
+		for _, gap := range gaps {
+			fmt.Printf("pool %s gap in %s\n", fifoLake.Pool(), gap)
+		}
 		if shaper != "" {
-			var err error
-			a, err = fifo.RunLocalQuery(ctx, zctx, a, shaper)
+			batch, err = fifo.RunLocalQuery(ctx, zctx, batch, shaper)
 			if err != nil {
 				return err
 			}
 		}
-		n := len(a.Values())
-		if n == 0 {
-			// Shaper dropped everything.
-			continue
-		}
-		commit, err := fifoLake.LoadBatch(ctx, zctx, a)
+		commit, n, err := fifoLake.LoadBatch(ctx, zctx, batch)
 		if err != nil {
 			return err
 		}
+		if n == 0 {
+			// The shaper dropped everything or another writer
+			// already committed it.
+			continue
+		}
 		fmt.Printf("pool %s commit %s %d record%s\n", fifoLake.Pool(), commit, n, plural(n))
 	}
 }
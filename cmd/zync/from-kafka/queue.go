@@ -0,0 +1,142 @@
+package fromkafka
+
+import (
+	"sync"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/zbuf"
+)
+
+// queue is a FIFO of values bound for one pool.  A queue never blocks its
+// writer.  Instead, when the bytes queued exceed the queue's limit, fetching
+// is paused for the queue's topics so that a slow pool applies backpressure
+// to Kafka rather than to other pools.  Fetching resumes once the queue
+// drains to half its limit.
+type queue struct {
+	flow   *flow
+	limit  int
+	topics []string
+
+	mu     sync.Mutex
+	vals   []zed.Value
+	bytes  int
+	paused bool
+
+	// ready has capacity one and receives a value whenever values are
+	// pushed onto an idle queue.
+	ready chan struct{}
+}
+
+func newQueue(flow *flow, limit int, topics []string) *queue {
+	return &queue{
+		flow:   flow,
+		limit:  limit,
+		topics: topics,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (q *queue) push(val zed.Value) {
+	q.mu.Lock()
+	q.vals = append(q.vals, val)
+	q.bytes += len(val.Bytes())
+	if q.bytes >= q.limit && !q.paused {
+		q.paused = true
+		q.flow.pause(q.topics)
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pop removes and returns the value at the head of the queue.  It returns
+// false if the queue is empty.
+func (q *queue) pop() (zed.Value, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.vals) == 0 {
+		return zed.Null, false
+	}
+	val := q.vals[0]
+	q.vals[0] = zed.Null
+	q.vals = q.vals[1:]
+	q.bytes -= len(val.Bytes())
+	if q.paused && q.bytes <= q.limit/2 {
+		q.paused = false
+		q.flow.resume(q.topics)
+	}
+	return val, true
+}
+
+// fill moves values from q to a, whose values take up size bytes, until q is
+// empty or a holds maxVals values or at least maxBytes bytes.  It returns the
+// bytes a then takes up and whether a is full.
+func (q *queue) fill(a *zbuf.Array, size, maxVals, maxBytes int) (int, bool) {
+	for len(a.Values()) < maxVals && size < maxBytes {
+		val, ok := q.pop()
+		if !ok {
+			return size, false
+		}
+		a.Append(val)
+		size += len(val.Bytes())
+	}
+	return size, true
+}
+
+// signal ensures a receive on q.ready will not block.
+func (q *queue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// flow pauses and resumes fetching for topics shared by multiple queues.
+// A topic remains paused until every queue that paused it has resumed it.
+type flow struct {
+	consumer pauser
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// pauser pauses and resumes fetching for topics.  It is implemented by
+// fifo.Consumer.
+type pauser interface {
+	Pause(topics ...string)
+	Resume(topics ...string)
+}
+
+func newFlow(consumer pauser) *flow {
+	return &flow{
+		consumer: consumer,
+		counts:   make(map[string]int),
+	}
+}
+
+func (f *flow) pause(topics []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paused []string
+	for _, topic := range topics {
+		if f.counts[topic]++; f.counts[topic] == 1 {
+			paused = append(paused, topic)
+		}
+	}
+	if len(paused) > 0 {
+		f.consumer.Pause(paused...)
+	}
+}
+
+func (f *flow) resume(topics []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resumed []string
+	for _, topic := range topics {
+		if f.counts[topic]--; f.counts[topic] == 0 {
+			resumed = append(resumed, topic)
+		}
+	}
+	if len(resumed) > 0 {
+		f.consumer.Resume(resumed...)
+	}
+}
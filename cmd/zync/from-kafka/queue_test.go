@@ -0,0 +1,109 @@
+package fromkafka
+
+import (
+	"testing"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/zbuf"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePauser records the topics paused and resumed.
+type fakePauser struct {
+	calls  []string
+	paused map[string]bool
+}
+
+func newFakePauser() *fakePauser {
+	return &fakePauser{paused: make(map[string]bool)}
+}
+
+func (f *fakePauser) Pause(topics ...string) {
+	for _, topic := range topics {
+		f.calls = append(f.calls, "pause "+topic)
+		f.paused[topic] = true
+	}
+}
+
+func (f *fakePauser) Resume(topics ...string) {
+	for _, topic := range topics {
+		f.calls = append(f.calls, "resume "+topic)
+		delete(f.paused, topic)
+	}
+}
+
+// value returns a value taking up n bytes.
+func value(n int) zed.Value {
+	return zed.NewString(string(make([]byte, n)))
+}
+
+func TestQueuePausesAndResumes(t *testing.T) {
+	pauser := newFakePauser()
+	q := newQueue(newFlow(pauser), 100, []string{"a", "b"})
+	q.push(value(60))
+	assert.Empty(t, pauser.calls)
+	select {
+	case <-q.ready:
+	default:
+		t.Fatal("push did not signal ready")
+	}
+	q.push(value(40))
+	assert.Equal(t, []string{"pause a", "pause b"}, pauser.calls)
+	// Pushing more does not pause again.
+	q.push(value(20))
+	assert.Len(t, pauser.calls, 2)
+	// Fetching resumes only once the queue drains to half its limit.
+	_, ok := q.pop()
+	assert.True(t, ok)
+	assert.Len(t, pauser.calls, 2)
+	_, ok = q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"pause a", "pause b", "resume a", "resume b"}, pauser.calls)
+	_, ok = q.pop()
+	assert.True(t, ok)
+	_, ok = q.pop()
+	assert.False(t, ok)
+	assert.Empty(t, pauser.paused)
+}
+
+func TestFlowSharedTopics(t *testing.T) {
+	pauser := newFakePauser()
+	flow := newFlow(pauser)
+	// Two pools sync topic b.
+	q1 := newQueue(flow, 10, []string{"a", "b"})
+	q2 := newQueue(flow, 10, []string{"b", "c"})
+	q1.push(value(10))
+	q2.push(value(10))
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, pauser.paused)
+	assert.Equal(t, []string{"pause a", "pause b", "pause c"}, pauser.calls)
+	// Topic b stays paused until both queues have drained.
+	q1.pop()
+	assert.Equal(t, map[string]bool{"b": true, "c": true}, pauser.paused)
+	q2.pop()
+	assert.Empty(t, pauser.paused)
+	assert.Equal(t, []string{"pause a", "pause b", "pause c", "resume a", "resume b", "resume c"}, pauser.calls)
+}
+
+func TestQueueFill(t *testing.T) {
+	q := newQueue(newFlow(newFakePauser()), 1000, []string{"a"})
+	for i := 0; i < 5; i++ {
+		q.push(value(30))
+	}
+	// The batch is full once it holds at least maxBytes bytes.
+	a := &zbuf.Array{}
+	size, full := q.fill(a, 0, 10, 50)
+	assert.True(t, full)
+	assert.Equal(t, 60, size)
+	assert.Len(t, a.Values(), 2)
+	// The batch is full once it holds maxVals values.
+	a = &zbuf.Array{}
+	size, full = q.fill(a, 0, 1, 1000)
+	assert.True(t, full)
+	assert.Equal(t, 30, size)
+	assert.Len(t, a.Values(), 1)
+	// The queue empties before the batch fills.
+	size, full = q.fill(a, size, 10, 1000)
+	assert.False(t, full)
+	assert.Equal(t, 90, size)
+	assert.Len(t, a.Values(), 3)
+}
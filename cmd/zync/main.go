@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"os"
 
+	_ "github.com/brimdata/zync/cmd/zync/compact"
 	_ "github.com/brimdata/zync/cmd/zync/consume"
 	_ "github.com/brimdata/zync/cmd/zync/etl"
 	_ "github.com/brimdata/zync/cmd/zync/from-kafka"
 	_ "github.com/brimdata/zync/cmd/zync/info"
 	_ "github.com/brimdata/zync/cmd/zync/ls"
 	_ "github.com/brimdata/zync/cmd/zync/produce"
+	_ "github.com/brimdata/zync/cmd/zync/prune"
 	"github.com/brimdata/zync/cmd/zync/root"
 	_ "github.com/brimdata/zync/cmd/zync/to-kafka"
 	_ "github.com/brimdata/zync/cmd/zync/version"
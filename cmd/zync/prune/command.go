@@ -0,0 +1,97 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/brimdata/zed/pkg/charm"
+	"github.com/brimdata/zync/cli"
+	"github.com/brimdata/zync/cmd/zync/root"
+	"github.com/brimdata/zync/etl"
+)
+
+var Spec = &charm.Spec{
+	Name:  "prune",
+	Usage: "prune [options] config.yaml",
+	Short: "delete input pool records already processed by zync etl",
+	Long: `
+The "prune" command deletes records from the input pools of config.yaml
+that "zync etl" has already processed, bounding the size of raw pools
+filled by "zync from-kafka".
+
+A record is deleted only if its offset and every earlier offset of its
+topic are covered by done records on the main branch of the output pool,
+so records not yet processed, such as denorm records still waiting for
+a match, are never deleted.  With -age, only records committed to the
+input pool at least that long ago are deleted, and with -keep, the records
+of the given number of latest offsets of each topic are kept.
+
+The records of each input pool are deleted in a single commit using the
+lake's delete-by-predicate support.  The commit records the pool's
+checkpoint, so "zync from-kafka" resumes where it left off.  If another
+writer commits to an input pool while it is being pruned, the pool is
+pruned again from its new head.
+`,
+	New: New,
+}
+
+func init() {
+	root.Zync.Add(Spec)
+}
+
+type Command struct {
+	*root.Command
+	lakeFlags cli.LakeFlags
+	age       time.Duration
+	keep      int64
+}
+
+func New(parent charm.Command, fs *flag.FlagSet) (charm.Command, error) {
+	c := &Command{Command: parent.(*root.Command)}
+	fs.DurationVar(&c.age, "age", 0, "if >0, delete only records committed at least this long ago")
+	fs.Int64Var(&c.keep, "keep", 0, "if >0, keep the records of this many latest offsets of each topic")
+	c.lakeFlags.SetFlags(fs)
+	return c, nil
+}
+
+func (c *Command) Run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no YAML config file provided")
+	}
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	config, err := etl.Load(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	lake, err := c.lakeFlags.Open(ctx)
+	if err != nil {
+		return err
+	}
+	pruned, err := etl.Prune(ctx, lake, config, etl.PruneOptions{Age: c.age, Keep: c.keep})
+	if err != nil {
+		return err
+	}
+	if len(pruned) == 0 {
+		fmt.Println("nothing to prune")
+	}
+	for _, p := range pruned {
+		fmt.Printf("pool %s topic %s: deleted %d record%s through offset %d in commit %s\n", p.Pool, p.Topic, p.Records, plural(p.Records), p.Through, p.Commit)
+	}
+	return nil
+}
+
+func plural(n int64) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
@@ -4,13 +4,23 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/brimdata/zed"
 	"github.com/brimdata/zed/pkg/charm"
 	"github.com/brimdata/zync/cli"
 	"github.com/brimdata/zync/cmd/zync/root"
+	"github.com/brimdata/zync/etl"
 	"github.com/brimdata/zync/fifo"
 	"github.com/riferrei/srclient"
+	"github.com/segmentio/ksuid"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sync/errgroup"
 )
 
 func init() {
@@ -19,66 +29,156 @@ func init() {
 
 var ToSpec = &charm.Spec{
 	Name:  "to-kafka",
-	Usage: "to-kafka [options]",
-	Short: "sync a Zed lake pool to a Kafka topic",
+	Usage: "to-kafka [options] [config.yaml ...]",
+	Short: "sync Zed lake pools to Kafka topics",
 	Long: `
-The "to-kafka" command syncs data from a Zed lake to a Kafka topic acting
+The "to-kafka" command syncs data from Zed lake pools to Kafka topics acting
 as a source of Zed data for Kafka.
 The Zed records are transcoded from Zed to Avro and synced
-to the target Kafka topic.
-The data pool must have the pool key "kafka.offset" sorted
-in ascending order.
+to the Kafka topic given by the kafka.topic field of each record.
+Topics and their source pools are read from the output and outputs sections
+of the config.yaml files.  A pool may also be specified via -pool, in which case
+only the topic given by -topic is synced or, if -topic is not set, every
+topic found in the pool when to-kafka starts and, with -follow, every topic
+found in the pool as new commits arrive.  Each topic is synced concurrently
+and independently of the others.
+
+The data pool is best sorted by the pool key "kafka.offset" in ascending
+order.  Other pool keys work but require sorting the records read from
+the pool.
+
+With -create, missing pools are created, empty, with the pool key and
+target data object size given by the orderby and thresh fields of the
+output route or else by -create.orderby and -create.thresh, so to-kafka
+can be started with -follow before anything writes to the pool.
+
+With -partitionby, each record is produced to the partition given by the
+value of its Zed expression, which is stored in the zync.partition field.
+Other records are partitioned by key in the same fashion as Kafka's Java
+client.  (The kafka.partition field, which records synced from Kafka carry,
+is not used.)
+
+The to-kafka command exits once the topic has caught up with the pool.
+With -follow, it instead keeps running, waiting for new commits to the
+pool and syncing them to the topic as they arrive, until it is interrupted
+or, if -exitafter is set, until that duration has elapsed.  In either case,
+a batch of records being produced is completed before exiting.
 
 Only a single writer is allowed at any given time to the Kafka topic.
-At start up, the to command queries the topic for its high-water mark
-and continues replicating data from the source data pool at that offset
-according to the kafka.offset value in the data pool.
+This is enforced with a lease for the topic, which is kept on the
+"zync-leases" branch of the pool and renewed every third of -lease.ttl.
+If the lease is held by another process, to-kafka exits or, with -lease.wait,
+waits for the lease to expire.  Setting -lease.ttl to 0 disables leases,
+as does a lake reached through a lake service rather than by its path.
+The lease is advisory: a process that stalls past -lease.ttl may produce
+records before it finds out that it lost the lease.  Use -transactional
+to have Kafka fence off such a process.
+With -transactional, each batch of records is produced atomically in a
+Kafka transaction whose transactional ID is derived from the pool and topic
+names.  A crash never leaves a partial batch visible to read_committed
+consumers, and when a new to-kafka process starts for the same pool and
+topic, Kafka fences off any older process still running.
+Each record produced carries the kafka.offset value of its pool record
+in the "zync.offset" record header.  At start up, the to-kafka command reads
+this header from the last record in each partition of the topic and
+continues replicating data from the source data pool after those offsets.
 `,
 	New: NewTo,
 }
 
 type To struct {
 	*root.Command
-	flags       cli.Flags
-	lakeFlags   cli.LakeFlags
-	shaper      cli.ShaperFlags
-	partitions  int
-	pool        string
-	replication int
+	createFlags   cli.CreateFlags
+	flags         cli.Flags
+	lakeFlags     cli.LakeFlags
+	leaseFlags    cli.LeaseFlags
+	shaper        cli.ShaperFlags
+	exitAfter     time.Duration
+	follow        bool
+	partitionBy   string
+	partitions    int
+	pool          string
+	replication   int
+	transactional bool
 }
 
 func NewTo(parent charm.Command, fs *flag.FlagSet) (charm.Command, error) {
 	f := &To{Command: parent.(*root.Command)}
-	fs.IntVar(&f.partitions, "partitions", 0, "if nonzero, create new Kafka topic with this many partitions")
+	fs.DurationVar(&f.exitAfter, "exitafter", 0, "if >0, exit after this duration")
+	fs.BoolVar(&f.follow, "follow", false, "after syncing, keep syncing new commits to the pool")
+	fs.StringVar(&f.partitionBy, "partitionby", "", "Zed expression computing the Kafka partition of each record")
+	fs.IntVar(&f.partitions, "partitions", 0, "if nonzero, create new Kafka topics with this many partitions")
 	fs.StringVar(&f.pool, "pool", "", "name of Zed data pool")
-	fs.IntVar(&f.replication, "replication", 1, "replication factor for new Kafka topic")
+	fs.IntVar(&f.replication, "replication", 1, "replication factor for new Kafka topics")
+	fs.BoolVar(&f.transactional, "transactional", false, "produce each batch atomically in a Kafka transaction")
+	f.createFlags.SetFlags(fs)
 	f.flags.SetFlags(fs)
 	f.lakeFlags.SetFlags(fs)
+	f.leaseFlags.SetFlags(fs)
 	f.shaper.SetFlags(fs)
 	return f, nil
 }
 
 func (t *To) Run(args []string) error {
-	if t.flags.Topic == "" {
-		return errors.New("no topic provided")
+	// A nil topic set means sync every topic found in the pool.
+	poolToTopics := map[string]map[string]struct{}{}
+	poolToRoute := map[string]etl.Route{}
+	if t.pool != "" {
+		var topics map[string]struct{}
+		if t.flags.Topic != "" {
+			topics = map[string]struct{}{t.flags.Topic: {}}
+		}
+		poolToTopics[t.pool] = topics
+		poolToRoute[t.pool] = etl.Route{Topic: t.flags.Topic, Pool: t.pool}
+	} else if t.flags.Topic != "" {
+		return errors.New("-topic requires -pool")
 	}
-	if t.pool == "" {
-		return errors.New("no pool provided")
-
+	for _, a := range args {
+		transform, err := etl.Load(a)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a, err)
+		}
+		for _, output := range transform.OutputRoutes() {
+			if output.Topic == "" || output.Pool == "" {
+				return fmt.Errorf("%s: output topic and pool must be specified", a)
+			}
+			topics, ok := poolToTopics[output.Pool]
+			if !ok {
+				topics = map[string]struct{}{}
+				poolToTopics[output.Pool] = topics
+			}
+			if topics != nil {
+				topics[output.Topic] = struct{}{}
+			}
+			if _, ok := poolToRoute[output.Pool]; !ok {
+				poolToRoute[output.Pool] = output
+			}
+		}
+	}
+	if len(poolToTopics) == 0 {
+		return errors.New("provide YAML config files or set -pool")
 	}
 	shaper, err := t.shaper.Load()
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
-	service, err := t.lakeFlags.Open(ctx)
-	if err != nil {
-		return err
+	if t.partitionBy != "" {
+		if shaper != "" {
+			shaper += "\n| "
+		}
+		shaper += fmt.Sprintf("%s:=(%s)", fifo.PartitionField, t.partitionBy)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if t.exitAfter > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.exitAfter)
+		defer cancel()
 	}
-	lk, err := fifo.NewLake(ctx, t.pool, shaper, service)
+	service, err := t.lakeFlags.Open(ctx)
 	if err != nil {
 		return err
 	}
+	t.leaseFlags.Check(service)
 	url, secret, err := cli.SchemaRegistryEndpoint()
 	if err != nil {
 		return err
@@ -87,18 +187,135 @@ func (t *To) Run(args []string) error {
 	if err != nil {
 		return err
 	}
-	if t.partitions > 0 {
-		if err := fifo.CreateMissingTopics(ctx, config, int32(t.partitions), int16(t.replication), nil, t.flags.Topic); err != nil {
-			return err
-		}
-	}
 	registry := srclient.CreateSchemaRegistryClient(url)
 	registry.SetCredentials(secret.User, secret.Password)
 	zctx := zed.NewContext()
-	producer, err := fifo.NewProducer(config, registry, t.flags.Format, t.flags.Topic, t.flags.Namespace)
-	if err != nil {
-		return err
+	var mu sync.Mutex
+	var leases []*fifo.Lease
+	defer func() { fifo.ReleaseAll(context.Background(), leases) }()
+	group, ctx := errgroup.WithContext(ctx)
+	// startSync starts syncing pool to topic, holding the topic's lease
+	// while it does.
+	startSync := func(lk *fifo.Lake, pool, topic string) error {
+		var fence []*fifo.Lease
+		if t.leaseFlags.TTL > 0 {
+			lease := fifo.NewLease(lk, "to-kafka/"+topic, t.leaseFlags.TTL)
+			if err := lease.Acquire(ctx, t.leaseFlags.Wait); err != nil {
+				return err
+			}
+			mu.Lock()
+			leases = append(leases, lease)
+			mu.Unlock()
+			fence = append(fence, lease)
+		}
+		var producer *fifo.Producer
+		var err error
+		if t.transactional {
+			producer, err = fifo.NewTransactionalProducer(config, registry, t.flags.Format, pool, topic, t.flags.Namespace)
+		} else {
+			producer, err = fifo.NewProducer(config, registry, t.flags.Format, topic, t.flags.Namespace)
+		}
+		if err != nil {
+			return err
+		}
+		if t.partitionBy != "" {
+			producer.UsePartitionField()
+		}
+		to := fifo.NewTo(zctx, producer, lk)
+		group.Go(func() error {
+			return fifo.Fence(ctx, fence, func(ctx context.Context) error {
+				return to.Sync(ctx, t.follow)
+			})
+		})
+		return nil
+	}
+	for pool, topics := range poolToTopics {
+		if err := t.createFlags.CreatePool(ctx, service, poolToRoute[pool]); err != nil {
+			return err
+		}
+		lk, err := fifo.NewLake(ctx, pool, shaper, service)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pool, err)
+		}
+		// Note the head before finding the topics so that a commit made
+		// after they are found prompts looking for new ones.
+		head, err := lk.Head(ctx)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pool, err)
+		}
+		topicList := maps.Keys(topics)
+		if topics == nil {
+			topicList, err = lk.Topics(ctx)
+			if err != nil {
+				return fmt.Errorf("pool %s: %w", pool, err)
+			}
+			if len(topicList) == 0 {
+				fmt.Printf("pool %s has no kafka.topic values to sync\n", pool)
+			}
+		}
+		if err := t.createTopics(ctx, config, topicList); err != nil {
+			return err
+		}
+		for _, topic := range topicList {
+			if err := startSync(lk, pool, topic); err != nil {
+				return err
+			}
+		}
+		if topics == nil && t.follow {
+			pool := pool
+			group.Go(func() error {
+				err := t.discoverTopics(ctx, lk, head, topicList, func(topic string) error {
+					if err := t.createTopics(ctx, config, []string{topic}); err != nil {
+						return err
+					}
+					return startSync(lk, pool, topic)
+				})
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			})
+		}
+	}
+	return group.Wait()
+}
+
+// createTopics creates the topics in topics that do not exist if -partitions
+// is set.
+func (t *To) createTopics(ctx context.Context, config []kgo.Opt, topics []string) error {
+	if t.partitions == 0 || len(topics) == 0 {
+		return nil
+	}
+	return fifo.CreateMissingTopics(ctx, config, int32(t.partitions), int16(t.replication), nil, topics...)
+}
+
+// discoverTopics waits for commits to the pool of lk after head and calls
+// sync for each kafka.topic value they add to the pool that is not in known,
+// until ctx is done or an error occurs.
+func (t *To) discoverTopics(ctx context.Context, lk *fifo.Lake, head ksuid.KSUID, known []string, sync func(string) error) error {
+	seen := make(map[string]bool)
+	for _, topic := range known {
+		seen[topic] = true
+	}
+	for {
+		var err error
+		head, err = lk.WaitForCommit(ctx, head)
+		if err != nil {
+			return err
+		}
+		topics, err := lk.Topics(ctx)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", lk.Pool(), err)
+		}
+		for _, topic := range topics {
+			if seen[topic] {
+				continue
+			}
+			seen[topic] = true
+			fmt.Printf("pool %s has new topic %s to sync\n", lk.Pool(), topic)
+			if err := sync(topic); err != nil {
+				return err
+			}
+		}
 	}
-	to := fifo.NewTo(zctx, producer, lk)
-	return to.Sync(ctx)
 }
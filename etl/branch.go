@@ -0,0 +1,138 @@
+package etl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/lakeparse"
+	"github.com/brimdata/zed/zson"
+	"github.com/segmentio/ksuid"
+)
+
+// MaxValidationErrors is the maximum number of values returned by a
+// validation query that are reported in the error returned by Validate.
+const MaxValidationErrors = 10
+
+var ErrValidation = errors.New("validation failed")
+
+// CreateBranch creates branch in pool at parent unless branch already exists.
+func CreateBranch(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, parent ksuid.KSUID) error {
+	err := service.CreateBranch(ctx, poolID, branch, parent)
+	if err != nil {
+		// The branch may already exist.  (The error type is lost
+		// when talking to a remote lake so look the branch up.)
+		if _, lookupErr := service.CommitObject(ctx, poolID, branch); lookupErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// CreateBranchFromMain creates branch from the head of main unless branch is
+// main or already exists.
+func CreateBranchFromMain(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string) error {
+	if branch == "main" {
+		return nil
+	}
+	head, err := service.CommitObject(ctx, poolID, "main")
+	if err != nil {
+		return err
+	}
+	return CreateBranch(ctx, service, poolID, branch, head)
+}
+
+// Validate runs the Zed query validate against branch of pool.  Each value
+// returned by the query is a validation failure, so Validate returns an
+// error wrapping ErrValidation if the query returns any values.
+func Validate(ctx context.Context, service lakeapi.Interface, pool, branch, validate string) error {
+	zr, err := service.Query(ctx, &lakeparse.Commitish{Pool: pool, Branch: branch}, validate)
+	if err != nil {
+		return err
+	}
+	batch, err := NewArrayFromReader(zr)
+	if err != nil {
+		return err
+	}
+	vals := batch.Values()
+	if len(vals) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for k, val := range vals {
+		if k == MaxValidationErrors {
+			fmt.Fprintf(&b, "\n  ... and %d more", len(vals)-k)
+			break
+		}
+		fmt.Fprintf(&b, "\n  %s", zson.FormatValue(val))
+	}
+	return fmt.Errorf("%w: pool %s branch %s: %d value%s returned%s", ErrValidation, pool, branch, len(vals), plural(len(vals)), b.String())
+}
+
+// MergeBranch validates branch of pool with the Zed query validate, unless
+// validate is empty, and merges branch into main by fast-forwarding main to
+// the head of branch.  The merge is made only if main has not changed since
+// branch was created from it, so readers of main see all of the branch's
+// commits at once, and main's new head records the branch's checkpoint.
+// Main is moved in a single atomic update of the branch journal, so it is
+// never missing or partly merged, except for a lake reached through a lake
+// service, as described in remote.go.  Branch is removed whether or not the
+// merge succeeds.  MergeBranch returns the new head of main or ksuid.Nil if
+// branch has no commits to merge.
+func MergeBranch(ctx context.Context, service lakeapi.Interface, pool string, poolID ksuid.KSUID, branch, validate string) (commit ksuid.KSUID, err error) {
+	if branch == "main" {
+		return ksuid.Nil, errors.New("cannot merge main into itself")
+	}
+	defer func() {
+		if removeErr := service.RemoveBranch(context.WithoutCancel(ctx), poolID, branch); err == nil {
+			err = removeErr
+		}
+	}()
+	if validate != "" {
+		if err := Validate(ctx, service, pool, branch, validate); err != nil {
+			return ksuid.Nil, err
+		}
+	}
+	head, err := service.CommitObject(ctx, poolID, "main")
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	branchHead, err := service.CommitObject(ctx, poolID, branch)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	if branchHead == head {
+		return ksuid.Nil, nil
+	}
+	if head != ksuid.Nil {
+		query := fmt.Sprintf("from %s@%q:log | has(id) ksuid(id)==%q | yield ksuid(id)", poolID, branch, head)
+		vals, err := queryValues(ctx, service, query)
+		if err != nil {
+			return ksuid.Nil, err
+		}
+		if len(vals) == 0 {
+			return ksuid.Nil, fmt.Errorf("%w: main has changed since branch %s was created", ErrConflict, branch)
+		}
+	}
+	if err := fastForwardMain(ctx, service, poolID, head, branchHead); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return ksuid.Nil, fmt.Errorf("%w: main has changed since branch %s was created", ErrConflict, branch)
+		}
+		return ksuid.Nil, err
+	}
+	return branchHead, nil
+}
+
+// fastForwardMain moves main from commit from to commit to.
+func fastForwardMain(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, from, to ksuid.KSUID) error {
+	if service.Root() == nil {
+		return fastForwardRemote(ctx, service, poolID, "main", from, to)
+	}
+	lp, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return err
+	}
+	return lp.fastForward(ctx, "main", from, to)
+}
@@ -4,31 +4,128 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
-// Currently, we take a brute force approach and compile a Zed script for
-// each output topic from scratch and we scan the entire range of each pool
-// for each step.  Later we can range-limit the scans based on the cursor of
-// each topic (note in this more generalized approach the cursor of an input
-// topic requires info from possible more than one output topic, but maybe
-// we won't handle this more generalized case until later).  For now, we require
-// all the input topics go through ETLs that land in the same *pool* but do not
-// require that they all land in the same output topic.  This way a cursor
-// query on the *pool* can reliably give us the cursor and the completed offsets
-// for anti-join.
+// The Zed for each output topic is compiled from scratch on every run, and
+// the Zeds for all output topics run as a single query.  Each input topic is
+// scanned from its cursor, the offset of its oldest record not yet processed,
+// so a run reads only what earlier runs have not finished with (see
+// Options.Cursors).  All input topics must be routed to the same output
+// *pool*, though they may land in different output topics, so that a query
+// on that pool reliably gives the done records for the anti-join that skips
+// records already processed.
 
+// Options adjust the Zed built from a Transform.
+type Options struct {
+	// Unsorted holds the names of pools whose records are not kept in
+	// kafka.offset order (see SortedByOffset) and must therefore be sorted
+	// before they are joined.
+	Unsorted map[string]bool
+	// Refs maps topics to references to their pools for from operators,
+	// e.g., a pool ID pinned to a commit, used in place of the pool names
+	// and branches given by the routes.
+	Refs map[string]string
+	// Cursors maps input topics to the offsets of their oldest records not
+	// yet processed.  Records and done records of an input topic below its
+	// cursor are not scanned.
+	Cursors map[string]int64
+}
+
+// Build returns a Zed query for each output topic of transform, assuming
+// every pool is sorted by kafka.offset.
 func Build(transform *Transform) ([]string, error) {
+	return BuildWithOptions(transform, Options{})
+}
+
+func BuildWithOptions(transform *Transform, opts Options) ([]string, error) {
+	routes, err := buildRoutes(transform)
+	if err != nil {
+		return nil, err
+	}
+	// For every input topic, we now know what output pool it is rounted to.
+	// There may be multiple output topics for a given input, but they all
+	// land in the same pool.
+
+	// For each output topic, we'll build a Zed for all the ETLs that
+	// land on that topic.   It's okay to have multiple ETLs landing
+	// on the same topic (e.g., multiple ETLs from different tables
+	// land on one denormalized table).
+
+	var zeds []string
+	for _, outputTopic := range routes.Outputs() {
+		var etls []Rule
+		for _, etl := range transform.ETLs {
+			if stringIn(outputTopic, etl.Outputs()) {
+				etls = append(etls, etl)
+			}
+		}
+		inputTopics := routes.InputsOf(outputTopic)
+		s, err := buildZed(inputTopics, outputTopic, routes, etls, buildUnselected(transform, routes, outputTopic), opts)
+		if err != nil {
+			return nil, err
+		}
+		zeds = append(zeds, s)
+	}
+	return zeds, nil
+}
+
+// doneType declares the type of done records, which mark input records
+// processed.
+const doneType = "type done = {kafka:{topic:string,offset:int64}}\n"
+
+// BuildQuery returns a Zed query running the Zeds of BuildWithOptions
+// together.  A done record may be yielded more than once, e.g., by the Zed of
+// each output topic an input topic is routed to or by a denorm rule for each
+// join result a record takes part in, so the done records are sorted and
+// each is passed just once.
+func BuildQuery(transform *Transform, opts Options) (string, error) {
+	zeds, err := BuildWithOptions(transform, opts)
+	if err != nil {
+		return "", err
+	}
+	code := doneType
+	code += "fork (\n"
+	for _, s := range zeds {
+		code += "  =>\n"
+		code += indent(strings.TrimPrefix(s, doneType), 4)
+	}
+	code += ")\n"
+	code += "| switch (\n"
+	code += "  case is(<done>) => sort kafka.topic, kafka.offset | uniq\n"
+	code += "  default => pass\n"
+	code += ")\n"
+	return code, nil
+}
+
+// buildRoutes returns the routes of transform with each input topic entered
+// along with the output topics its ETLs land on.
+func buildRoutes(transform *Transform) (*Routes, error) {
 	routes, err := newRoutes(transform)
 	if err != nil {
 		return nil, err
 	}
-	// First, for each output topic, we compute all of the input topics
+	// For each output topic, we compute all of the input topics
 	// needed by all of the ETLs to that output.  Note that an input
 	// topic may be routed to multiple output topics but all of those
-	// topics must be in the same pool (XXX add a check for this).
+	// topics must be in the output pool, which Routes.enter checks.
 	for _, etl := range transform.ETLs {
 		switch etl.Type {
 		case "denorm":
+			if len(etl.Tables) > 0 {
+				if etl.Left != "" || etl.Right != "" || etl.Join != "" {
+					return nil, errors.New("'left', 'right', or 'join-on' cannot be specified with 'tables' for denorm ETL")
+				}
+				if etl.In != "" {
+					return nil, errors.New("'in' topic cannot be specified for denorm ETL")
+				}
+				for _, table := range etl.Tables {
+					if err := routes.enter(table.Topic, etl.Out); err != nil {
+						return nil, err
+					}
+				}
+				break
+			}
 			if etl.Left == "" || etl.Right == "" {
 				return nil, errors.New("both 'left' and 'right' topics must be specified for denorm ETL")
 			}
@@ -51,43 +148,50 @@ func Build(transform *Transform) ([]string, error) {
 			if err := routes.enter(etl.In, etl.Out); err != nil {
 				return nil, err
 			}
+		case "transaction":
+			if etl.In == "" {
+				return nil, errors.New("'in' transaction metadata topic must be specified for transaction ETL")
+			}
+			if len(etl.Topics) == 0 {
+				return nil, errors.New("'topics' must be specified for transaction ETL")
+			}
+			if etl.Left != "" || etl.Right != "" {
+				return nil, errors.New("'left' or 'right' topic cannot be specified for transaction ETL")
+			}
+			if etl.Where != "" {
+				// Filtering events would keep transactions from completing.
+				return nil, errors.New("'where' cannot be specified for transaction ETL")
+			}
+			for _, topic := range append([]string{etl.In}, etl.Topics...) {
+				if err := routes.enter(topic, etl.Out); err != nil {
+					return nil, err
+				}
+			}
+		case "materialize":
+			if etl.In == "" {
+				return nil, errors.New("'in' topic must be specified for materialize ETL")
+			}
+			if etl.Left != "" || etl.Right != "" {
+				return nil, errors.New("'left' or 'right' topic cannot be specified for materialize ETL")
+			}
+			for _, out := range etl.Outputs() {
+				if err := routes.enter(etl.In, out); err != nil {
+					return nil, err
+				}
+			}
 		default:
 			return nil, fmt.Errorf("unknown ETL type: %q", etl.Type)
 		}
 	}
-	// For every input topic, we now know what output pool it is rounted to.
-	// There may be multiple output topics for a given input, but they all
-	// land in the same pool.
-
-	// For each output topic, we'll build a Zed for all the ETLs that
-	// land on that topic.   It's okay to have multiple ETLs landing
-	// on the same topic (e.g., multiple ETLs from different tables
-	// land on one denormalized table).
-
-	var zeds []string
-	for _, outputTopic := range routes.Outputs() {
-		var etls []Rule
-		for _, etl := range transform.ETLs {
-			if etl.Out == outputTopic {
-				etls = append(etls, etl)
-			}
-		}
-		inputTopics := routes.InputsOf(outputTopic)
-		s, err := buildZed(inputTopics, outputTopic, routes, etls)
-		if err != nil {
-			return nil, err
-		}
-		zeds = append(zeds, s)
-	}
-	return zeds, nil
+	return routes, nil
 }
 
-func buildZed(inputTopics []string, outputTopic string, routes *Routes, etls []Rule) (string, error) {
-	code, err := buildFrom(inputTopics, outputTopic, routes)
+func buildZed(inputTopics []string, outputTopic string, routes *Routes, etls []Rule, unselected string, opts Options) (string, error) {
+	code, err := buildFrom(inputTopics, outputTopic, routes, opts)
 	if err != nil {
 		return "", err
 	}
-	code = "type done = {kafka:{topic:string,offset:int64}}\n" + code
+	code = doneType + code
 	code += "| yield this\n" //XXX switch can't handle multiple parents
 	code += "| switch (\n"
 	for _, etl := range etls {
@@ -95,40 +199,184 @@ func buildZed(inputTopics []string, outputTopic string, routes *Routes, etls []R
 		case "stateless":
 			code += buildStateless(etl)
 		case "denorm":
-			denorm, err := buildDenorm(etl)
+			build := buildDenorm
+			if len(etl.Tables) > 0 {
+				build = buildDenormTables
+			}
+			denorm, err := build(etl)
 			if err != nil {
 				return "", err
 			}
 			code += denorm
+		case "transaction":
+			code += buildTransaction(etl)
+		case "materialize":
+			code += buildMaterialize(etl, outputTopic)
 		default:
 			return "", fmt.Errorf("unknown ETL type: %q", etl.Type)
 		}
 	}
+	code += unselected
 	code += ")\n| sort kafka.offset\n"
 	return code, nil
 }
 
+// buildUnselected returns the switch cases that mark done the records of the
+// input topics routed to outputTopic that no rule of transform selects, so
+// they do not hold back their topics' cursors.  An input topic routed to
+// more than one output topic gets its case in the Zed of the first.
+func buildUnselected(transform *Transform, routes *Routes, outputTopic string) string {
+	var code string
+	for _, topic := range routes.InputsOf(outputTopic) {
+		if routes.inputs[topic][0] != outputTopic {
+			continue
+		}
+		var selected []string
+		for _, etl := range transform.ETLs {
+			if topics, pred := selection(etl); stringIn(topic, topics) {
+				selected = append(selected, pred)
+			}
+		}
+		code += fmt.Sprintf("  case kafka.topic==%q and not (%s) =>\n", topic, strings.Join(selected, " or "))
+		code += "    yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
+	}
+	return code
+}
+
+// selection returns the input topics of etl and the predicate selecting
+// the records it processes.
+func selection(etl Rule) ([]string, string) {
+	var where string
+	if etl.Where != "" {
+		where = fmt.Sprintf("(%s) and ", etl.Where)
+	}
+	var topics []string
+	switch etl.Type {
+	case "denorm":
+		if len(etl.Tables) > 0 {
+			for _, table := range etl.Tables {
+				topics = append(topics, table.Topic)
+			}
+		} else {
+			topics = []string{etl.Left, etl.Right}
+		}
+	case "transaction":
+		txid := etl.TxID
+		if txid == "" {
+			txid = "value.transaction.id"
+		}
+		var events []string
+		for _, topic := range etl.Topics {
+			events = append(events, fmt.Sprintf("kafka.topic==%q", topic))
+		}
+		pred := fmt.Sprintf("(kafka.topic==%q and value.status in [\"BEGIN\",\"END\"]) or ((%s) and has(%s))", etl.In, strings.Join(events, " or "), txid)
+		return append([]string{etl.In}, etl.Topics...), pred
+	default:
+		topics = []string{etl.In}
+	}
+	var preds []string
+	for _, topic := range topics {
+		preds = append(preds, fmt.Sprintf("kafka.topic==%q", topic))
+	}
+	pred := fmt.Sprintf("(%s)", strings.Join(preds, " or "))
+	if where != "" {
+		pred = fmt.Sprintf("(%s%s)", where, pred)
+	}
+	return topics, pred
+}
+
 const fromTemplate = `
 from (
-  pool %q => kafka.topic==%q
-  pool %q => is(<done>) kafka.topic==%q
+  pool %s => kafka.topic==%q%s%s
+  pool %s => is(<done>) kafka.topic==%q%s%s
 ) | anti join on kafka.offset=kafka.offset
 `
 
-func buildFrom(inputTopics []string, outputTopic string, routes *Routes) (string, error) {
+// BuildPending returns a Zed query that yields the topic and offset of
+// each input record of transform not yet covered by a done record, i.e.,
+// not yet processed, at or above its topic's cursor in opts.
+func BuildPending(transform *Transform, opts Options) (string, error) {
+	routes, err := buildRoutes(transform)
+	if err != nil {
+		return "", err
+	}
+	inputTopics := routes.Inputs()
+	if len(inputTopics) == 0 {
+		return "", errors.New("no input topics found")
+	}
+	code, err := buildFrom(inputTopics, transform.Output.Topic, routes, opts)
+	if err != nil {
+		return "", err
+	}
+	code = doneType + code
+	code += "| yield {topic:kafka.topic,offset:kafka.offset}\n"
+	return code, nil
+}
+
+// BuildOffsets returns a Zed query that yields the topic and offset of each
+// input record of transform at or above its topic's cursor in opts, whether
+// processed or not, sorted by topic and offset with duplicates removed.
+func BuildOffsets(transform *Transform, opts Options) (string, error) {
+	routes, err := buildRoutes(transform)
+	if err != nil {
+		return "", err
+	}
+	inputTopics := routes.Inputs()
+	if len(inputTopics) == 0 {
+		return "", errors.New("no input topics found")
+	}
+	code := "from (\n"
+	for _, topic := range inputTopics {
+		code += fmt.Sprintf("  pool %s => kafka.topic==%q%s | yield {topic:kafka.topic,offset:kafka.offset}\n", poolRef(routes, topic, opts), topic, cursorFilter(topic, opts))
+	}
+	code += ") | sort topic, offset | uniq\n"
+	return code, nil
+}
+
+// cursorFilter returns the Zed that limits a scan of topic to the offsets
+// at or above its cursor.  When the pool key is kafka.offset, the lake uses
+// the filter to skip data objects entirely below the cursor.
+func cursorFilter(topic string, opts Options) string {
+	if cursor, ok := opts.Cursors[topic]; ok && cursor > 0 {
+		return fmt.Sprintf(" kafka.offset>=%d", cursor)
+	}
+	return ""
+}
+
+// poolRef returns the reference to the pool of topic for a from operator.
+func poolRef(routes *Routes, topic string, opts Options) string {
+	if ref, ok := opts.Refs[topic]; ok {
+		return ref
+	}
+	return routes.LookupPoolRef(topic)
+}
+
+// sortLeg returns the Zed that puts the records read from pool in kafka.offset
+// order for a join.
+func sortLeg(pool string, opts Options) string {
+	if opts.Unsorted[pool] {
+		return " | sort kafka.offset"
+	}
+	return ""
+}
+
+func buildFrom(inputTopics []string, outputTopic string, routes *Routes, opts Options) (string, error) {
 	switch len(inputTopics) {
 	case 0:
 		//XXX can't happen
 		return "", errors.New("no input topics found")
 	case 1:
 		inTopic := inputTopics[0]
-		inPool := routes.LookupPool(inTopic)
-		outPool := routes.LookupPool(outputTopic)
-		return fmt.Sprintf(fromTemplate, inPool, inTopic, outPool, inTopic), nil
+		inPool := poolRef(routes, inTopic, opts)
+		inSort := sortLeg(routes.LookupPool(inTopic), opts)
+		outPool := poolRef(routes, outputTopic, opts)
+		outSort := sortLeg(routes.LookupPool(outputTopic), opts)
+		cursor := cursorFilter(inTopic, opts)
+		return fmt.Sprintf(fromTemplate, inPool, inTopic, cursor, inSort, outPool, inTopic, cursor, outSort), nil
 	}
 	var code string
 	for k := range inputTopics {
-		s, err := buildFrom(inputTopics[k:k+1], outputTopic, routes)
+		s, err := buildFrom(inputTopics[k:k+1], outputTopic, routes, opts)
 		if err != nil {
 			return "", err
 		}
@@ -194,23 +442,328 @@ func buildDenorm(etl Rule) (string, error) {
 	}
 	leftKey := strings.TrimSpace(keys[0])
 	rightKey := strings.TrimSpace(keys[1])
-	code := fmt.Sprintf("  case %s =>\n", etl.Where)
+	join := "fork (\n"
+	join += fmt.Sprintf("  => kafka.topic==%q | yield {left:this} | sort %s\n", etl.Left, leftKey)
+	join += fmt.Sprintf("  => kafka.topic==%q | yield {right:this} | sort %s\n", etl.Right, rightKey)
+	join += ")\n"
+	join += fmt.Sprintf("| join on %s=%s right:=right\n", leftKey, rightKey)
+	join += "| fork (\n"
+	join += "  =>\n"
+	join += "      // === user-defined ETL ===\n"
+	join += formatZedHead(etl.Zed, 4)
+	join += "    | out.kafka:=left.kafka\n"
+	join += "    | yield out\n"
+	join += fmt.Sprintf("    | kafka.topic:=%q\n", etl.Out)
+	join += "  => yield cast({kafka:{topic:left.kafka.topic,offset:left.kafka.offset}},done)\n"
+	join += "  => yield cast({kafka:{topic:right.kafka.topic,offset:right.kafka.offset}},done)\n"
+	join += ")\n"
+	_, pred := selection(etl)
+	code := fmt.Sprintf("  case %s =>\n", pred)
+	if etl.Timeout == "" {
+		return code + indent(join, 4), nil
+	}
+	timeout, err := time.ParseDuration(etl.Timeout)
+	if err != nil {
+		return "", fmt.Errorf("timeout of denorm rule: %w", err)
+	}
+	// Run the join under a fork with the expiry legs.
+	expireLeft := buildExpire(etl, "left", etl.Left, leftKey, "right", etl.Right, rightKey, timeout)
+	expireRight := buildExpire(etl, "right", etl.Right, rightKey, "left", etl.Left, leftKey, timeout)
+	code += "    fork (\n"
+	code += "      =>\n"
+	code += indent(join, 8)
+	code += "      =>\n"
+	code += indent(expireLeft, 8)
+	code += "      =>\n"
+	code += indent(expireRight, 8)
+	code += "    )\n"
+	return code, nil
+}
+
+// buildExpire returns the Zed that expires the records of topic in a denorm
+// rule that have no match among the records of other and whose time is more
+// than timeout ago.  An expired record is passed to the rule's fallback Zed
+// if it has one or else recorded with an expired record giving the reason.
+// Either way, it is marked done so it no longer holds back its topic's
+// cursor.
+func buildExpire(etl Rule, field, topic, key, otherField, other, otherKey string, timeout time.Duration) string {
+	code := "fork (\n"
+	code += fmt.Sprintf("  => kafka.topic==%q | yield {%s:this} | sort %s\n", topic, field, key)
+	code += fmt.Sprintf("  => kafka.topic==%q | yield {%s:this} | sort %s\n", other, otherField, otherKey)
+	code += ")\n"
+	code += fmt.Sprintf("| anti join on %s=%s\n", key, otherKey)
+	code += fmt.Sprintf("| yield %s\n", field)
+	code += buildExpired(etl, fmt.Sprintf("no match in %s within %s", other, timeout), timeout)
+	return code
+}
+
+// buildExpired returns the Zed that expires the records it receives, records
+// of a denorm rule with no match, whose time is more than timeout ago as
+// described for buildExpire.
+func buildExpired(etl Rule, reason string, timeout time.Duration) string {
+	ts := etl.Time
+	if ts == "" {
+		ts = "time(value.ts_ms*1000000)"
+	}
+	code := fmt.Sprintf("| where %s < now()-%s\n", ts, timeout)
+	code += "| fork (\n"
+	if etl.Fallback != "" {
+		code += "  =>\n"
+		code += "    yield {in:this}\n"
+		code += "    // === user-defined fallback ===\n"
+		code += formatZed(etl.Fallback, 4)
+		code += "    | out.kafka:=in.kafka\n"
+		code += "    | yield out\n"
+		code += fmt.Sprintf("    | kafka.topic:=%q\n", etl.Out)
+	} else {
+		code += fmt.Sprintf("  => yield cast({expired:{topic:kafka.topic,offset:kafka.offset},reason:%q},\"expired\")\n", reason)
+	}
+	code += "  => yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
+	code += ")\n"
+	return code
+}
+
+// buildDenormTables returns the Zed for a denorm rule joining the topics of
+// its tables in order, each with the join of the tables before it, so
+// ((A join B) join C) and so on.  Each table's record is held in the field
+// named for the table.  A left join keeps the records of the tables before it
+// that have no match, leaving the table's field missing.  Without a timeout,
+// such a row is transformed at once, so a match arriving later is never
+// joined.  With a timeout, the row is held back, its records left pending,
+// until the time of the first table's record is more than the timeout ago,
+// and any record that takes part in no join result is expired as described
+// for buildExpire once its own time is more than the timeout ago.  Every
+// record taking part in a join result is marked done.
+func buildDenormTables(etl Rule) (string, error) {
+	if len(etl.Tables) < 2 {
+		return "", errors.New("denorm ETL must have at least two tables")
+	}
+	if etl.Tables[0].On != "" || etl.Tables[0].Join != "" {
+		return "", fmt.Errorf("first table %q of denorm ETL cannot be joined", etl.Tables[0].Topic)
+	}
+	for _, table := range etl.Tables {
+		if !isIdentifier(table.Field()) {
+			return "", fmt.Errorf("table %q of denorm ETL needs 'as' to name its field with a Zed identifier", table.Topic)
+		}
+	}
+	var timeout time.Duration
+	var hold string
+	if etl.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(etl.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("timeout of denorm rule: %w", err)
+		}
+		hold = fmt.Sprintf("zync_time < now()-%s", timeout)
+	}
+	first := etl.Tables[0]
+	joined := fmt.Sprintf("kafka.topic==%q | yield {%s:this}", first.Topic, first.Field())
+	if hold != "" {
+		ts := etl.Time
+		if ts == "" {
+			ts = "time(value.ts_ms*1000000)"
+		}
+		joined = fmt.Sprintf("kafka.topic==%q | yield {%s:this,zync_time:%s}", first.Topic, first.Field(), ts)
+	}
+	for _, table := range etl.Tables[1:] {
+		keys := strings.Split(table.On, "=")
+		if len(keys) != 2 {
+			if table.On == "" {
+				return "", fmt.Errorf("no join-on expression provided for table %q in denorm rule", table.Topic)
+			}
+			return "", fmt.Errorf("join-on syntax error: %q", table.On)
+		}
+		var join string
+		switch table.Join {
+		case "", "inner":
+			join = "join"
+		case "left":
+			join = "left join"
+		default:
+			return "", fmt.Errorf("unknown join %q for table %q in denorm rule", table.Join, table.Topic)
+		}
+		leftKey := strings.TrimSpace(keys[0])
+		rightKey := strings.TrimSpace(keys[1])
+		field := table.Field()
+		code := "fork (\n"
+		code += fmt.Sprintf("  => %s | sort %s\n", strings.TrimSpace(indent(joined, 4)), leftKey)
+		code += fmt.Sprintf("  => kafka.topic==%q | yield {%s:this} | sort %s\n", table.Topic, field, rightKey)
+		code += ")\n"
+		code += fmt.Sprintf("| %s on %s=%s %s:=%s", join, leftKey, rightKey, field, field)
+		if join == "left join" && hold != "" {
+			code += fmt.Sprintf("\n| has(%s) or %s", field, hold)
+		}
+		joined = code
+	}
+	if hold != "" {
+		joined += "\n| drop zync_time"
+	}
+	join := joined + "\n"
+	join += "| fork (\n"
+	join += "  =>\n"
+	join += "      // === user-defined ETL ===\n"
+	join += formatZedHead(etl.Zed, 4)
+	join += fmt.Sprintf("    | out.kafka:=%s.kafka\n", first.Field())
+	join += "    | yield out\n"
+	join += fmt.Sprintf("    | kafka.topic:=%q\n", etl.Out)
+	join += "  =>\n"
+	join += "    fork (\n"
+	for _, table := range etl.Tables {
+		field := table.Field()
+		join += fmt.Sprintf("      => has(%s) | yield cast({kafka:{topic:%s.kafka.topic,offset:%s.kafka.offset}},done)\n", field, field, field)
+	}
+	join += "    )\n"
+	join += ")\n"
+	_, pred := selection(etl)
+	code := fmt.Sprintf("  case %s =>\n", pred)
+	if hold == "" {
+		return code + indent(join, 4), nil
+	}
+	// Expire the records that take part in no join result, i.e., that
+	// the join marks no done, and the join's done records pass through.
+	code += "    fork (\n"
+	code += "      =>\n"
+	code += indent(join, 8)
+	code += "      => yield {zync_pending:this}\n"
+	code += "    )\n"
+	code += "    | switch (\n"
+	code += "      case has(zync_pending) or is(<done>) =>\n"
+	code += "        fork (\n"
+	code += "          => is(<done>)\n"
+	code += "          =>\n"
+	expire := "fork (\n"
+	expire += "  => has(zync_pending) | yield {key:{topic:zync_pending.kafka.topic,offset:zync_pending.kafka.offset},in:zync_pending} | sort key\n"
+	expire += "  => is(<done>) | yield {key:kafka} | sort key\n"
+	expire += ")\n"
+	expire += "| anti join on key=key\n"
+	expire += "| yield in\n"
+	expire += buildExpired(etl, fmt.Sprintf("no join within %s", timeout), timeout)
+	code += indent(expire, 12)
+	code += "        )\n"
+	code += "      default => pass\n"
+	code += "    )\n"
+	return code, nil
+}
+
+// buildTransaction returns the Zed for a transaction rule, which transforms
+// the events of each database transaction together once all of them have
+// arrived.  Debezium marks the end of a transaction with an END event in the
+// transaction metadata topic giving the number of events of each table
+// written by the transaction in data_collections, so a transaction is
+// complete when its END event and as many distinct events with its ID as
+// it gives for the rule's topics are pending.  Until then, its events stay
+// unprocessed.  The user-defined Zed receives a record holding the
+// transaction ID in txid, the events in events, in the order of
+// value.transaction.total_order, and the END event in end, and it creates a
+// record in a field called out for each output record.  The results of a
+// transaction land in a single commit along with the done records of its
+// events.  Events without a transaction ID are left to other rules, and
+// BEGIN events and the END events of transactions with no events in the
+// rule's topics are marked done as they carry nothing needed.
+func buildTransaction(etl Rule) string {
+	txid := etl.TxID
+	if txid == "" {
+		txid = "value.transaction.id"
+	}
+	var topics []string
+	for _, topic := range etl.Topics {
+		topics = append(topics, fmt.Sprintf("kafka.topic==%q", topic))
+	}
+	count := fmt.Sprintf("coalesce((over value.data_collections | data_collection in %s | sum(event_count)),0)", dataCollections(etl.Topics))
+	code := fmt.Sprintf("  case kafka.topic==%q and value.status==\"BEGIN\" =>\n", etl.In)
+	code += "    yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
+	code += fmt.Sprintf("  case kafka.topic==%q and value.status==\"END\" and %s==0 =>\n", etl.In, count)
+	code += "    yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
+	code += fmt.Sprintf("  case (kafka.topic==%q and value.status==\"END\") or ((%s) and has(%s)) =>\n", etl.In, strings.Join(topics, " or "), txid)
 	code += "    fork (\n"
-	code += fmt.Sprintf("      => kafka.topic==%q | yield {left:this} | sort %s\n", etl.Left, leftKey)
-	code += fmt.Sprintf("      => kafka.topic==%q | yield {right:this} | sort %s\n", etl.Right, rightKey)
+	code += "      =>\n"
+	code += fmt.Sprintf("        kafka.topic!=%q\n", etl.In)
+	code += "        | event:=any(this) by topic:=kafka.topic,offset:=kafka.offset\n"
+	code += "        | yield event\n"
+	code += "        | sort value.transaction.total_order\n"
+	code += fmt.Sprintf("        | events:=collect(this) by txid:=%s\n", txid)
+	code += "        | sort txid\n"
+	code += fmt.Sprintf("      => kafka.topic==%q | yield {txid:value.id,end:this,count:%s} | sort txid\n", etl.In, count)
 	code += "    )\n"
-	code += fmt.Sprintf("    | join on %s=%s right:=right\n", leftKey, rightKey)
+	code += "    | join on txid=txid end:=end,count:=count\n"
+	code += "    | len(events)==count\n"
 	code += "    | fork (\n"
 	code += "      =>\n"
 	code += "          // === user-defined ETL ===\n"
 	code += formatZedHead(etl.Zed, 8)
-	code += "        | out.kafka:=left.kafka\n"
 	code += "        | yield out\n"
-	code += fmt.Sprintf("        | kafka.topic:=%q\n", etl.Out)
-	code += "      =>  yield {\n"
-	code += "             left:cast({kafka:{topic:left.kafka.topic,offset:left.kafka.offset}},done),\n"
-	code += "             right:cast({kafka:{topic:right.kafka.topic,offset:right.kafka.offset}},done)\n"
-	code += "          }\n"
+	code += fmt.Sprintf("        | kafka:={topic:%q,offset:0}\n", etl.Out)
+	code += "      => yield cast({kafka:{topic:end.kafka.topic,offset:end.kafka.offset}},done)\n"
+	code += "      => over events | yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
 	code += "    )\n"
-	return code, nil
+	return code
+}
+
+// dataCollections returns a Zed array of the names under which Debezium may
+// list the tables of topics in the data_collections of a transaction's END
+// event.  A data collection is named for its table, e.g., inventory.orders,
+// and the topic of a table is usually the same name with a prefix, e.g.,
+// dbserver1.inventory.orders, so these are each topic and its suffixes
+// following a dot.
+func dataCollections(topics []string) string {
+	var names []string
+	for _, topic := range topics {
+		names = append(names, fmt.Sprintf("%q", topic))
+		for k, r := range topic {
+			if r == '.' {
+				names = append(names, fmt.Sprintf("%q", topic[k+1:]))
+			}
+		}
+	}
+	return "[" + strings.Join(names, ",") + "]"
+}
+
+// buildMaterialize returns the Zed for a materialize rule, which keeps the
+// current state of the rows of a table in the output topic from the Debezium
+// change events of the table in the input topic.  Of the pending events,
+// only the latest of each key matters, so for each key changed since the
+// previous run, the output topic gets one record holding the key and either
+// the row built by the user-defined Zed from the key's latest create, read,
+// or update event or, if the row was deleted, null.  The latest event of a
+// key is the one with its greatest kafka.offset.  The latest record of a key
+// in the output topic is thus the key's current row.  When outputTopic is
+// the rule's sink topic, the same records are written there as upserts and
+// tombstones for a JDBC sink connector.
+func buildMaterialize(etl Rule, outputTopic string) string {
+	var where string
+	if etl.Where != "" {
+		where = fmt.Sprintf("(%s) and ", etl.Where)
+	}
+	key := etl.Key
+	if key == "" {
+		key = "key"
+	}
+	zed := etl.Zed
+	if strings.TrimSpace(zed) == "" {
+		zed = "out:=in.value.after"
+	}
+	code := fmt.Sprintf("  case %skafka.topic==%q =>\n", where, etl.In)
+	code += "    fork (\n"
+	code += "      =>\n"
+	code += "        fork (\n"
+	// Debezium follows each delete event with a tombstone, whose null
+	// value carries no op, so tombstones are only marked done.
+	code += fmt.Sprintf("          => value!=null | latest:=max(kafka.offset) by key:=%s | sort latest\n", key)
+	code += "          => yield {in:this} | sort in.kafka.offset\n"
+	code += "        )\n"
+	code += "        | join on latest=in.kafka.offset in:=in\n"
+	code += "        | switch (\n"
+	code += "          case in.value.op==\"d\" =>\n"
+	code += fmt.Sprintf("            yield {key,value:null,kafka:{topic:%q,offset:in.kafka.offset}}\n", outputTopic)
+	code += "          case in.value.op in [\"c\",\"r\",\"u\"] =>\n"
+	code += "            yield {key,in}\n"
+	code += "\n    // === user-defined ETL ===\n"
+	code += formatZed(zed, 12)
+	code += "\n"
+	code += fmt.Sprintf("            | yield {key,value:out,kafka:{topic:%q,offset:in.kafka.offset}}\n", outputTopic)
+	code += "        )\n"
+	code += "      =>\n"
+	code += "        yield cast({kafka:{topic:kafka.topic,offset:kafka.offset}},done)\n"
+	code += "      )\n"
+	return code
 }
@@ -0,0 +1,219 @@
+package etl
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/brimdata/zed/compiler"
+	"github.com/brimdata/zed/compiler/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an error in a config file found by Check.
+type Problem struct {
+	Line int // line of the config file or 0 if unknown
+	Err  error
+}
+
+func (p Problem) Error() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s", p.Line, p.Err)
+	}
+	return p.Err.Error()
+}
+
+// Check loads the config file at path and returns the problems that would
+// keep the transform it describes from running, as far as can be told
+// without a lake: unknown keys, which Load rejects; invalid routes, including
+// rules landing outside the output pool; and Zed snippets that do not parse.
+// Each rule is checked by itself so that a problem in one does not hide
+// problems in another.  Check returns an error only if the file cannot be
+// read or is not valid YAML.
+func Check(path string) ([]Problem, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return []Problem{{Err: errors.New("empty config")}}, nil
+	}
+	doc := root.Content[0]
+	var problems []Problem
+	var transform Transform
+	if err := decode(b, &transform); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, decodeProblem(msg))
+		}
+	}
+	rules := lookupNode(doc, "transforms")
+	ruleNode := func(k int) *yaml.Node {
+		if rules == nil || rules.Kind != yaml.SequenceNode || k >= len(rules.Content) {
+			return nil
+		}
+		return rules.Content[k]
+	}
+	if _, err := newRoutes(&transform); err != nil {
+		problems = append(problems, Problem{Err: err})
+		return problems, nil
+	}
+	// Add the rules one at a time, leaving out those that fail to build
+	// so they do not cause problems to be reported for the rules after.
+	good := transform
+	good.ETLs = nil
+	for k, rule := range transform.ETLs {
+		node := ruleNode(k)
+		snippetProblems := checkSnippets(rule, node)
+		problems = append(problems, snippetProblems...)
+		next := good
+		next.ETLs = append(next.ETLs[:len(next.ETLs):len(next.ETLs)], rule)
+		if _, err := Build(&next); err != nil {
+			problems = append(problems, Problem{nodeLine(node), fmt.Errorf("transform %d: %w", k+1, err)})
+			continue
+		}
+		if len(snippetProblems) == 0 {
+			good = next
+		}
+	}
+	if len(transform.ETLs) == 0 {
+		problems = append(problems, Problem{Err: errors.New("no transforms found")})
+	}
+	if len(problems) > 0 {
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].Line < problems[j].Line
+		})
+		return problems, nil
+	}
+	// The snippets parse by themselves, so a problem here means one of
+	// them does not fit where it is placed in the Zed built for a rule.
+	zeds, err := Build(&transform)
+	if err != nil {
+		return []Problem{{Err: err}}, nil
+	}
+	for _, s := range zeds {
+		if _, err := compiler.Parse(s); err != nil {
+			problems = append(problems, Problem{Err: fmt.Errorf("built Zed: %w", err)})
+		}
+	}
+	return problems, nil
+}
+
+// decodeProblem returns the problem for msg, an error found by the YAML
+// decoder, which starts with the line it was found on, e.g., "line 9: unknown
+// key transfroms".
+func decodeProblem(msg string) Problem {
+	var line int
+	if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+		if _, text, ok := strings.Cut(msg, ": "); ok {
+			return Problem{line, errors.New(text)}
+		}
+	}
+	return Problem{Err: errors.New(msg)}
+}
+
+// checkSnippets parses each Zed snippet of rule, whose mapping in the config
+// file is node, and returns a problem for each that does not parse.
+func checkSnippets(rule Rule, node *yaml.Node) []Problem {
+	var problems []Problem
+	check := func(key, prefix, src string, val *yaml.Node) {
+		if strings.TrimSpace(src) == "" {
+			return
+		}
+		if _, err := compiler.Parse(prefix + src); err != nil {
+			problems = append(problems, snippetProblem(key, prefix, src, val, err))
+		}
+	}
+	// Snippets of Zed operators are placed after a pipe symbol, so one
+	// may start with one.  It is blanked out rather than removed to keep
+	// the offsets of parse errors.
+	op := func(src string) string {
+		if i := strings.IndexFunc(src, func(r rune) bool { return !unicode.IsSpace(r) }); i >= 0 && src[i] == '|' {
+			return src[:i] + " " + src[i+1:]
+		}
+		return src
+	}
+	check("where", "where ", rule.Where, lookupNode(node, "where"))
+	check("zed", "", op(rule.Zed), lookupNode(node, "zed"))
+	check("fallback", "", op(rule.Fallback), lookupNode(node, "fallback"))
+	check("time", "yield ", rule.Time, lookupNode(node, "time"))
+	check("key", "yield ", rule.Key, lookupNode(node, "key"))
+	check("txid", "yield ", rule.TxID, lookupNode(node, "txid"))
+	check("join-on", "join on ", rule.Join, lookupNode(node, "join-on"))
+	tables := lookupNode(node, "tables")
+	for k, table := range rule.Tables {
+		var tableNode *yaml.Node
+		if tables != nil && tables.Kind == yaml.SequenceNode && k < len(tables.Content) {
+			tableNode = tables.Content[k]
+		}
+		check("join-on", "join on ", table.On, lookupNode(tableNode, "join-on"))
+	}
+	return problems
+}
+
+// snippetProblem returns the problem for the parse error err of the snippet
+// src of key, which was parsed following prefix.  If err gives the position
+// of the error, the problem gives the line of the config file holding it.
+func snippetProblem(key, prefix, src string, val *yaml.Node, err error) Problem {
+	line := nodeLine(val)
+	var perr *parser.Error
+	if !errors.As(err, &perr) || line == 0 {
+		return Problem{line, fmt.Errorf("%s: %w", key, err)}
+	}
+	offset := perr.Offset - len(prefix)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(src) {
+		offset = len(src)
+	}
+	if val.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		// A block scalar starts on the line after its indicator.
+		line++
+	}
+	line += strings.Count(src[:offset], "\n")
+	start := strings.LastIndexByte(src[:offset], '\n') + 1
+	text := src[start:]
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	// Columns count from the first nonblank character of the line since
+	// the indentation of a block scalar is not part of its value.
+	trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+	column := offset - start - (len(text) - len(trimmed))
+	if column < 0 {
+		column = 0
+	}
+	return Problem{line, fmt.Errorf("%s: error parsing Zed at column %d of %q", key, column+1, strings.TrimSpace(trimmed))}
+}
+
+// lookupNode returns the value of key in the mapping node or nil if node is
+// not a mapping or has no such key.
+func lookupNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for k := 0; k+1 < len(node.Content); k += 2 {
+		if node.Content[k].Value == key {
+			return node.Content[k+1]
+		}
+	}
+	return nil
+}
+
+func nodeLine(node *yaml.Node) int {
+	if node == nil {
+		return 0
+	}
+	return node.Line
+}
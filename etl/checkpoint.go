@@ -0,0 +1,241 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/brimdata/zed"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/zson"
+	"github.com/segmentio/ksuid"
+)
+
+// Checkpoint is the sync state of a pool as of a commit: the largest
+// kafka.offset of each Kafka topic partition in the pool.  Writers record
+// a checkpoint in the metadata of each commit so that on startup they can
+// find where they left off by reading the commit log instead of querying
+// the pool.  For an ETL output pool, the checkpoint covers the input topics
+// of the done records as well as the output topics, and it also records the
+// cursor of each input topic: the offset of its oldest record not yet
+// processed, below which ETL need not scan.  A checkpoint also names the
+// holders of the leases that writers to the pool require, so that a writer
+// whose lease was taken over finds out before it commits again.
+type Checkpoint struct {
+	Offsets []PartitionOffset `zed:"offsets"`
+	Cursors []Cursor          `zed:"cursors"`
+	Holders []Holder          `zed:"holders"`
+}
+
+// Holder is the owner of a lease as of a checkpoint.
+type Holder struct {
+	Lease string `zed:"lease"`
+	Owner string `zed:"owner"`
+}
+
+type Cursor struct {
+	Topic  string `zed:"topic"`
+	Offset int64  `zed:"offset"`
+}
+
+type PartitionOffset struct {
+	Topic     string `zed:"topic"`
+	Partition int64  `zed:"partition"`
+	Offset    int64  `zed:"offset"`
+}
+
+// LoadCheckpoint returns the checkpoint of pool as of commit.  The checkpoint
+// is read from the metadata of commit if present.  Otherwise, it is computed
+// by querying the pool.
+func LoadCheckpoint(ctx context.Context, service lakeapi.Interface, poolID, commit ksuid.KSUID) (*Checkpoint, error) {
+	if commit == ksuid.Nil {
+		// The pool is empty.
+		return &Checkpoint{}, nil
+	}
+	c, err := loadRecordedCheckpoint(ctx, service, poolID, commit)
+	if c != nil || err != nil {
+		return c, err
+	}
+	query := fmt.Sprintf("from %s@%s | has(kafka.topic) | offset:=max(kafka.offset) by topic:=kafka.topic,partition:=coalesce(kafka.partition,0) | sort topic,partition", poolID, commit)
+	vals, err := queryValues(ctx, service, query)
+	if err != nil {
+		return nil, err
+	}
+	c = &Checkpoint{}
+	for _, val := range vals {
+		var o PartitionOffset
+		if err := zson.UnmarshalZNG(val, &o); err != nil {
+			return nil, err
+		}
+		c.Offsets = append(c.Offsets, o)
+	}
+	return c, nil
+}
+
+// loadRecordedCheckpoint returns the checkpoint recorded in the metadata of
+// commit or nil if there is none.
+func loadRecordedCheckpoint(ctx context.Context, service lakeapi.Interface, poolID, commit ksuid.KSUID) (*Checkpoint, error) {
+	query := fmt.Sprintf("from %s@%s:log | has(id) | head 1 | has(meta.zync_checkpoint) | yield meta.zync_checkpoint", poolID, commit)
+	vals, err := queryValues(ctx, service, query)
+	if err != nil || len(vals) != 1 {
+		return nil, err
+	}
+	var c Checkpoint
+	if err := zson.UnmarshalZNG(vals[0], &c); err != nil {
+		return nil, fmt.Errorf("commit %s: bad checkpoint: %w", commit, err)
+	}
+	return &c, nil
+}
+
+// NextOffsets returns, for each topic in c, the offset following the
+// largest offset of any of its partitions.
+func (c *Checkpoint) NextOffsets() map[string]int64 {
+	offsets := make(map[string]int64)
+	for _, o := range c.Offsets {
+		if next, ok := offsets[o.Topic]; !ok || o.Offset+1 > next {
+			offsets[o.Topic] = o.Offset + 1
+		}
+	}
+	return offsets
+}
+
+// Advance returns a copy of c advanced past the kafka.offset of each
+// value in vals.
+func (c *Checkpoint) Advance(vals []zed.Value) (*Checkpoint, error) {
+	a := c.advancer()
+	for _, val := range vals {
+		if _, _, err := a.advance(val); err != nil {
+			return nil, err
+		}
+	}
+	return a.checkpoint(), nil
+}
+
+type partitionKey struct {
+	topic     string
+	partition int64
+}
+
+// advancer accumulates the advance of a checkpoint one value at a time so
+// values streamed to a pool need not be held in memory.
+type advancer struct {
+	offsets map[partitionKey]int64
+	cursors []Cursor
+	holders []Holder
+}
+
+func (c *Checkpoint) advancer() *advancer {
+	offsets := make(map[partitionKey]int64)
+	for _, o := range c.Offsets {
+		offsets[partitionKey{o.Topic, o.Partition}] = o.Offset
+	}
+	return &advancer{offsets: offsets, cursors: c.Cursors, holders: c.Holders}
+}
+
+// advance advances the checkpoint past the kafka.offset of val and returns
+// the kafka.topic and kafka.offset of val.
+func (a *advancer) advance(val zed.Value) (string, int64, error) {
+	kafka, err := Field(val, "kafka")
+	if err != nil {
+		return "", 0, err
+	}
+	topic, err := FieldAsString(kafka, "topic")
+	if err != nil {
+		return "", 0, err
+	}
+	offset, err := FieldAsInt(kafka, "offset")
+	if err != nil {
+		return "", 0, err
+	}
+	var partition int64
+	if p := kafka.Deref("partition"); p != nil && zed.IsInteger(p.Type().ID()) && !p.IsNull() {
+		partition = p.AsInt()
+	}
+	k := partitionKey{topic, partition}
+	if max, ok := a.offsets[k]; !ok || offset > max {
+		a.offsets[k] = offset
+	}
+	return topic, offset, nil
+}
+
+func (a *advancer) checkpoint() *Checkpoint {
+	next := &Checkpoint{Cursors: a.cursors, Holders: a.holders}
+	for k, offset := range a.offsets {
+		next.Offsets = append(next.Offsets, PartitionOffset{k.topic, k.partition, offset})
+	}
+	sort.Slice(next.Offsets, func(i, j int) bool {
+		a, b := next.Offsets[i], next.Offsets[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	return next
+}
+
+// CursorMap returns the cursors of c by topic.
+func (c *Checkpoint) CursorMap() map[string]int64 {
+	cursors := make(map[string]int64)
+	for _, cursor := range c.Cursors {
+		cursors[cursor.Topic] = cursor.Offset
+	}
+	return cursors
+}
+
+// WithCursors returns a copy of c with its cursors replaced by cursors.
+func (c *Checkpoint) WithCursors(cursors map[string]int64) *Checkpoint {
+	next := &Checkpoint{Offsets: c.Offsets, Holders: c.Holders}
+	for topic, offset := range cursors {
+		next.Cursors = append(next.Cursors, Cursor{topic, offset})
+	}
+	sort.Slice(next.Cursors, func(i, j int) bool {
+		return next.Cursors[i].Topic < next.Cursors[j].Topic
+	})
+	return next
+}
+
+// Holder returns the owner of lease as of c or the empty string if c names
+// no owner.
+func (c *Checkpoint) Holder(lease string) string {
+	for _, h := range c.Holders {
+		if h.Lease == lease {
+			return h.Owner
+		}
+	}
+	return ""
+}
+
+// WithHolder returns a copy of c naming owner as the holder of lease.
+func (c *Checkpoint) WithHolder(lease, owner string) *Checkpoint {
+	next := &Checkpoint{Offsets: c.Offsets, Cursors: c.Cursors, Holders: []Holder{{lease, owner}}}
+	for _, h := range c.Holders {
+		if h.Lease != lease {
+			next.Holders = append(next.Holders, h)
+		}
+	}
+	sort.Slice(next.Holders, func(i, j int) bool {
+		return next.Holders[i].Lease < next.Holders[j].Lease
+	})
+	return next
+}
+
+// Meta returns c formatted as commit metadata.
+func (c *Checkpoint) Meta() (string, error) {
+	s, err := zson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("{zync_checkpoint:%s}", s), nil
+}
+
+func queryValues(ctx context.Context, service lakeapi.Interface, query string) ([]zed.Value, error) {
+	zr, err := service.Query(ctx, nil, query)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := NewArrayFromReader(zr)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Values(), nil
+}
@@ -0,0 +1,90 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/brimdata/zed/api"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/segmentio/ksuid"
+)
+
+// Compact merges the data objects of branch of pool smaller than the pool's
+// target object size into larger objects as described for CompactIfHead.
+// If another writer commits to branch while Compact is working, Compact
+// starts over from the new head as described for RetryConflicts.  Compact
+// returns the compaction commit, or ksuid.Nil if there was nothing to
+// compact, and the number of objects compacted.
+func Compact(ctx context.Context, service lakeapi.Interface, pool, branch string) (ksuid.KSUID, int, error) {
+	config, err := lakeapi.LookupPoolByName(ctx, service, pool)
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	var commit ksuid.KSUID
+	var n int
+	err = RetryConflicts(ctx, func() error {
+		head, err := service.CommitObject(ctx, config.ID, branch)
+		if err != nil {
+			return err
+		}
+		checkpoint, err := LoadCheckpoint(ctx, service, config.ID, head)
+		if err != nil {
+			return err
+		}
+		commit, n, err = CompactIfHead(ctx, service, config.ID, branch, head, checkpoint, config.Threshold)
+		return err
+	}, func(err error) {
+		fmt.Printf("pool %s %s: retrying\n", pool, err)
+	})
+	return commit, n, err
+}
+
+// CompactIfHead merges the data objects of branch as of head that are
+// smaller than thresh into objects in pool key order, which for pools sorted
+// by kafka.offset is offset order.  Compaction does not change what queries
+// of the pool return, and the compaction commit records checkpoint, the
+// checkpoint as of head, so writers resuming from the commit's metadata find
+// the same offsets as before.  The compaction is kept only if it directly
+// follows head as described for commitIfHead.  CompactIfHead returns the
+// compaction commit, or ksuid.Nil if there are fewer than two small
+// objects, and the number of objects compacted.
+func CompactIfHead(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID, checkpoint *Checkpoint, thresh int64) (ksuid.KSUID, int, error) {
+	if head == ksuid.Nil {
+		return ksuid.Nil, 0, nil
+	}
+	query := fmt.Sprintf("from %s@%s:objects | size<%d | yield {id:ksuid(id)}", poolID, head, thresh)
+	vals, err := queryValues(ctx, service, query)
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	if len(vals) < 2 {
+		return ksuid.Nil, 0, nil
+	}
+	var objects []ksuid.KSUID
+	for _, val := range vals {
+		s, err := FieldAsString(val, "id")
+		if err != nil {
+			return ksuid.Nil, 0, err
+		}
+		id, err := ksuid.Parse(s)
+		if err != nil {
+			return ksuid.Nil, 0, err
+		}
+		objects = append(objects, id)
+	}
+	meta, err := checkpoint.Meta()
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	message := api.CommitMessage{
+		Body: fmt.Sprintf("compact %d objects", len(objects)),
+		Meta: meta,
+	}
+	commit, err := commitIfHead(ctx, service, poolID, branch, head, func(private string) (ksuid.KSUID, error) {
+		return service.Compact(ctx, poolID, private, objects, false, message)
+	})
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	return commit, len(objects), nil
+}
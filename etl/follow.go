@@ -0,0 +1,154 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// FollowOptions control the pace of Pipeline.Follow.
+type FollowOptions struct {
+	// Interval is the minimum interval between the starts of two runs.
+	Interval time.Duration
+	// If nonzero, a random delay of up to Jitter is added to Interval so
+	// that several followers of the same input pools do not run in step.
+	Jitter time.Duration
+}
+
+// Stats describes a run of the transform by Pipeline.Follow.
+type Stats struct {
+	Run      int           // number of the run, counting from 1
+	Records  int           // records transformed by the run
+	Duration time.Duration // duration of the run
+	Total    int           // records transformed by all runs so far
+}
+
+// MaxFollowBackoff bounds the wait of Pipeline.Follow before it retries a
+// failed run.
+const MaxFollowBackoff = time.Minute
+
+// Follow runs the transform as Run does and then runs it again whenever the
+// branch of any input pool gets a new commit, calling report after each run,
+// until ctx is done.  A run interrupted by ctx commits nothing, since its
+// output lands in a single commit, so Follow then returns nil.  A failed run,
+// e.g., because the lake is briefly unavailable, is retried after a wait that
+// doubles with each failure in a row up to MaxFollowBackoff.
+func (p *Pipeline) Follow(ctx context.Context, opts FollowOptions, report func(Stats)) error {
+	var stats Stats
+	var backoff time.Duration
+	for {
+		runs := stats.Run
+		err := p.follow(ctx, opts, &stats, report)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if stats.Run > runs {
+			backoff = 0
+		}
+		if backoff = 2 * backoff; backoff == 0 {
+			backoff = time.Second
+		} else if backoff > MaxFollowBackoff {
+			backoff = MaxFollowBackoff
+		}
+		fmt.Printf("%s: retrying in %s\n", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// follow runs the transform for Follow until a run fails or ctx is done.
+func (p *Pipeline) follow(ctx context.Context, opts FollowOptions, stats *Stats, report func(Stats)) error {
+	for {
+		// Note the input heads before the run so a commit made during
+		// the run ends the wait below.
+		heads, err := p.inputHeads(ctx)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		n, err := p.Run(ctx)
+		if err != nil {
+			return err
+		}
+		stats.Run++
+		stats.Records = n
+		stats.Duration = time.Since(start)
+		stats.Total += n
+		report(*stats)
+		// An input branch that is also the output branch has moved
+		// with the run's own commit, which must not start another run,
+		// so its wait starts from the head the run left it at.  Another
+		// writer's commit before that would have failed the run's commit
+		// with a conflict and been seen by its retry.
+		for k, h := range heads {
+			if h.poolID == p.outputPool.poolID && h.branch == p.outputPool.branch {
+				heads[k].head = p.outputPool.head
+			}
+		}
+		if err := p.waitForInput(ctx, heads); err != nil {
+			return err
+		}
+		delay := time.Until(start.Add(opts.Interval))
+		if opts.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(opts.Jitter)))
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+type branchHead struct {
+	poolID ksuid.KSUID
+	branch string
+	head   ksuid.KSUID
+}
+
+// inputHeads returns the head commit of the branch of each input pool.
+func (p *Pipeline) inputHeads(ctx context.Context) ([]branchHead, error) {
+	var heads []branchHead
+	seen := make(map[branchHead]bool)
+	for _, route := range p.transform.Inputs {
+		branch := route.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		key := branchHead{poolID: p.inputPools[route.Pool].ID(), branch: branch}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		head, err := p.service.CommitObject(ctx, key.poolID, branch)
+		if err != nil {
+			return nil, err
+		}
+		key.head = head
+		heads = append(heads, key)
+	}
+	return heads, nil
+}
+
+// waitForInput waits until the branch of any input pool in heads has a head
+// commit other than the one in heads.
+func (p *Pipeline) waitForInput(ctx context.Context, heads []branchHead) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan error, len(heads))
+	for _, h := range heads {
+		go func(h branchHead) {
+			_, err := WaitForCommit(ctx, p.service, h.poolID, h.branch, h.head)
+			ch <- err
+		}(h)
+	}
+	return <-ch
+}
@@ -0,0 +1,333 @@
+package etl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/api"
+	"github.com/brimdata/zed/lake"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/lake/branches"
+	"github.com/brimdata/zed/lake/commits"
+	"github.com/brimdata/zed/lake/journal"
+	"github.com/brimdata/zed/zio"
+	"github.com/brimdata/zed/zson"
+	"github.com/segmentio/ksuid"
+	"go.uber.org/zap"
+)
+
+// ErrConflict is returned by LoadIfHead and the other conditional commits
+// when another writer committed to the branch after the head commit the
+// commit was based on.
+var ErrConflict = errors.New("branch changed by another writer")
+
+// ErrLakeService is returned by CommitMetaIfHead, ReplaceMeta, and HeadMeta
+// for a lake reached through a Zed lake service, whose API has no
+// conditional commit and no way to write a commit without data.  The other
+// conditional commits fall back to the lake API for such a lake.
+var ErrLakeService = errors.New("commits without data require direct access to the lake, not a lake service")
+
+// MaxConflictRetries is the number of times RetryConflicts retries after a
+// conflict before giving up.
+const MaxConflictRetries = 10
+
+// LoadIfHead loads r onto branch in a commit whose parent is head.  If
+// branch has moved past head, nothing is committed and LoadIfHead returns an
+// error wrapping ErrConflict.  The branch pointer is moved with the lake's
+// atomic compare-and-swap on the branch journal, so readers of branch never
+// see a commit that is not kept, and of two writers loading onto the same
+// head, exactly one succeeds.  For a lake reached through a lake service,
+// these guarantees are weakened as described in remote.go.
+func LoadIfHead(ctx context.Context, service lakeapi.Interface, zctx *zed.Context, poolID ksuid.KSUID, branch string, head ksuid.KSUID, r zio.Reader, message api.CommitMessage) (ksuid.KSUID, error) {
+	return loadIfHead(ctx, service, zctx, poolID, branch, head, r, message.Author, message.Body, func() (string, error) {
+		return message.Meta, nil
+	})
+}
+
+// loadIfHead is LoadIfHead with the commit metadata returned by meta, which
+// is called once r is exhausted.
+func loadIfHead(ctx context.Context, service lakeapi.Interface, zctx *zed.Context, poolID ksuid.KSUID, branch string, head ksuid.KSUID, r zio.Reader, author, body string, meta func() (string, error)) (ksuid.KSUID, error) {
+	if service.Root() == nil {
+		return loadIfHeadRemote(ctx, service, zctx, poolID, branch, head, r, author, body, meta)
+	}
+	pool, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	// Fail early if another writer got in first rather than after
+	// writing data objects that cannot be committed.
+	if err := pool.checkHead(ctx, branch, head); err != nil {
+		return ksuid.Nil, err
+	}
+	w, err := lake.NewWriter(ctx, zctx, pool.Pool)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	err = zio.CopyWithContext(ctx, w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	o := commits.NewAddsObject(head, 0, author, body, zed.Null, w.Objects())
+	if err == nil && len(w.Objects()) == 0 {
+		err = commits.ErrEmptyTransaction
+	}
+	if err == nil {
+		err = setCommitMeta(o, meta)
+	}
+	if err == nil {
+		if body == "" {
+			o.Actions[0].(*commits.Commit).Message = fmt.Sprintf("loaded %d data object%s", len(w.Objects()), plural(len(w.Objects())))
+		}
+		err = pool.commit(ctx, branch, o)
+	}
+	if err != nil {
+		pool.discard(context.WithoutCancel(ctx), o)
+		return ksuid.Nil, err
+	}
+	return o.Commit, nil
+}
+
+// setCommitMeta sets the metadata of the commit of o to the ZSON value
+// returned by meta.
+func setCommitMeta(o *commits.Object, meta func() (string, error)) error {
+	s, err := meta()
+	if err != nil || s == "" {
+		return err
+	}
+	val, err := zson.ParseValue(zed.NewContext(), s)
+	if err != nil {
+		return fmt.Errorf("commit metadata %q: %w", s, err)
+	}
+	o.Actions[0].(*commits.Commit).Meta = val
+	return nil
+}
+
+// CommitMetaIfHead commits no data but only the metadata in message onto
+// branch in a commit whose parent is head.  If branch has moved past head,
+// nothing is committed and CommitMetaIfHead returns an error wrapping
+// ErrConflict.
+func CommitMetaIfHead(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID, message api.CommitMessage) (ksuid.KSUID, error) {
+	pool, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	o := commits.NewObject(head, message.Author, message.Body, zed.Null, 0)
+	if err := setCommitMeta(o, func() (string, error) { return message.Meta, nil }); err != nil {
+		return ksuid.Nil, err
+	}
+	if err := pool.commit(ctx, branch, o); err != nil {
+		return ksuid.Nil, err
+	}
+	return o.Commit, nil
+}
+
+// ReplaceMeta moves branch from head to a new commit with no data and no
+// parent that records the metadata in message, so that branch holds only
+// its latest state and reading that state takes a single lookup.  If
+// branch has moved past head, nothing is committed and ReplaceMeta returns
+// an error wrapping ErrConflict.  The commit at head is removed if it was
+// made by ReplaceMeta, as nothing else refers to it.
+func ReplaceMeta(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID, message api.CommitMessage) (ksuid.KSUID, error) {
+	pool, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	o := commits.NewObject(ksuid.Nil, message.Author, message.Body, zed.Null, 0)
+	if err := setCommitMeta(o, func() (string, error) { return message.Meta, nil }); err != nil {
+		return ksuid.Nil, err
+	}
+	if err := pool.commits.Put(ctx, o); err != nil {
+		return ksuid.Nil, err
+	}
+	if err := pool.fastForward(ctx, branch, head, o.Commit); err != nil {
+		pool.commits.Remove(context.WithoutCancel(ctx), o)
+		return ksuid.Nil, err
+	}
+	if head != ksuid.Nil {
+		if old, err := pool.commits.Get(ctx, head); err == nil && old.Parent == ksuid.Nil && len(old.Actions) == 1 {
+			pool.commits.Remove(ctx, old)
+		}
+	}
+	return o.Commit, nil
+}
+
+// HeadMeta returns the head commit of branch and its metadata, which is
+// null if branch has no commits or the commit has no metadata.
+func HeadMeta(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string) (ksuid.KSUID, zed.Value, error) {
+	pool, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return ksuid.Nil, zed.Null, err
+	}
+	config, err := pool.branches.LookupByName(ctx, branch)
+	if err != nil {
+		return ksuid.Nil, zed.Null, err
+	}
+	if config.Commit == ksuid.Nil {
+		return ksuid.Nil, zed.Null, nil
+	}
+	o, err := pool.commits.Get(ctx, config.Commit)
+	if err != nil {
+		return ksuid.Nil, zed.Null, err
+	}
+	for _, action := range o.Actions {
+		if c, ok := action.(*commits.Commit); ok {
+			return config.Commit, c.Meta, nil
+		}
+	}
+	return config.Commit, zed.Null, nil
+}
+
+// commitIfHead makes a commit to branch by calling commit, which must make
+// exactly one commit to the branch it is given, on a private branch created
+// at head and then moving branch to the private branch's head if branch is
+// still at head.  Otherwise, it discards the commit and returns an error
+// wrapping ErrConflict.  The private branch is removed in any case.
+func commitIfHead(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID, commit func(branch string) (ksuid.KSUID, error)) (ksuid.KSUID, error) {
+	if service.Root() == nil {
+		return commitIfHeadRemote(ctx, service, poolID, branch, head, commit)
+	}
+	pool, err := openLakePool(ctx, service, poolID)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	if err := pool.checkHead(ctx, branch, head); err != nil {
+		return ksuid.Nil, err
+	}
+	private := fmt.Sprintf("zync-commit-%s", ksuid.New())
+	if err := service.CreateBranch(ctx, poolID, private, head); err != nil {
+		return ksuid.Nil, err
+	}
+	defer service.RemoveBranch(context.WithoutCancel(ctx), poolID, private)
+	id, err := commit(private)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	if err := pool.fastForward(ctx, branch, head, id); err != nil {
+		if o, getErr := pool.commits.Get(ctx, id); getErr == nil {
+			pool.discard(context.WithoutCancel(ctx), o)
+		}
+		return ksuid.Nil, err
+	}
+	return id, nil
+}
+
+// RetryConflicts calls try until it returns an error not wrapping
+// ErrConflict or until it has retried MaxConflictRetries times.  Before each
+// retry, it calls retry, if not nil, with the conflict and then waits for a
+// random time whose bound doubles with each retry so that writers contending
+// for a branch do not keep colliding.
+func RetryConflicts(ctx context.Context, try func() error, retry func(error)) error {
+	bound := 50 * time.Millisecond
+	for retries := 0; ; retries++ {
+		err := try()
+		if !errors.Is(err, ErrConflict) || retries == MaxConflictRetries {
+			return err
+		}
+		if retry != nil {
+			retry(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(bound)))):
+		}
+		if bound < 5*time.Second {
+			bound *= 2
+		}
+	}
+}
+
+// lakePool gives access to the commit and branch stores of a pool in a
+// local lake, which the conditional commits need since the lake API does
+// not expose its compare-and-swap on the branch journal.
+type lakePool struct {
+	*lake.Pool
+	branches *branches.Store
+	commits  *commits.Store
+}
+
+func openLakePool(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID) (*lakePool, error) {
+	root := service.Root()
+	if root == nil {
+		return nil, ErrLakeService
+	}
+	pool, err := root.OpenPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	logger := zap.NewNop()
+	branchStore, err := branches.OpenStore(ctx, pool.Storage(), logger, pool.Path.JoinPath(lake.BranchesTag))
+	if err != nil {
+		return nil, err
+	}
+	commitStore, err := commits.OpenStore(pool.Storage(), logger, pool.Path.JoinPath(lake.CommitsTag))
+	if err != nil {
+		return nil, err
+	}
+	return &lakePool{pool, branchStore, commitStore}, nil
+}
+
+// checkHead returns an error wrapping ErrConflict if branch is not at head.
+func (p *lakePool) checkHead(ctx context.Context, branch string, head ksuid.KSUID) error {
+	config, err := p.branches.LookupByName(ctx, branch)
+	if err != nil {
+		return err
+	}
+	if config.Commit != head {
+		return fmt.Errorf("%w: expected head %s but found %s", ErrConflict, head, config.Commit)
+	}
+	return nil
+}
+
+// commit writes o to the commit store and moves branch to it if branch is
+// still at the parent of o.  Otherwise, it removes o from the commit store
+// and returns an error wrapping ErrConflict.
+func (p *lakePool) commit(ctx context.Context, branch string, o *commits.Object) error {
+	if err := p.commits.Put(ctx, o); err != nil {
+		return err
+	}
+	if err := p.fastForward(ctx, branch, o.Parent, o.Commit); err != nil {
+		p.commits.Remove(context.WithoutCancel(ctx), o)
+		return err
+	}
+	return nil
+}
+
+// fastForward moves branch from commit from to commit to, which must have
+// from in its history, as a single atomic update of the branch journal.  If
+// branch is not at from, fastForward returns an error wrapping ErrConflict.
+func (p *lakePool) fastForward(ctx context.Context, branch string, from, to ksuid.KSUID) error {
+	config, err := p.branches.LookupByName(ctx, branch)
+	if err != nil {
+		return err
+	}
+	if config.Commit != from {
+		return fmt.Errorf("%w: expected head %s but found %s", ErrConflict, from, config.Commit)
+	}
+	config.Commit = to
+	err = p.branches.Update(ctx, config, func(e journal.Entry) bool {
+		entry, ok := e.(*branches.Config)
+		return ok && entry.Commit == from
+	})
+	if err == journal.ErrConstraint {
+		return fmt.Errorf("%w: expected head %s but branch %s moved", ErrConflict, from, branch)
+	}
+	return err
+}
+
+// discard removes o, a commit that was not kept, from the commit store along
+// with the data objects it added, which no other commit refers to.  Errors
+// are ignored since the caller is already returning an error and since an
+// unreferenced file does not change what queries return.
+func (p *lakePool) discard(ctx context.Context, o *commits.Object) {
+	for _, action := range o.Actions {
+		if add, ok := action.(*commits.Add); ok {
+			add.Object.Remove(ctx, p.Storage(), p.DataPath)
+		}
+	}
+	p.commits.Remove(ctx, o)
+}
@@ -0,0 +1,109 @@
+package etl
+
+import (
+	"fmt"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/zcode"
+	"github.com/brimdata/zed/zio"
+	"github.com/brimdata/zed/zson"
+)
+
+// outputReader reads the results of a transform's Zeds and yields the
+// records to load into the output pool: each output record with its
+// kafka.offset set to the next offset of its topic and the done records,
+// which the query yields just once each (see BuildQuery).  Records are
+// streamed from the query to the load, so only the state needed to advance
+// the checkpoint is kept in memory.
+type outputReader struct {
+	zr       zio.Reader
+	offsets  map[string]int64 // next offset of each output topic
+	advancer *advancer
+	builder  *zcode.Builder
+	n        int // done records, i.e., input records processed
+	records  int // records yielded
+}
+
+func newOutputReader(zr zio.Reader, checkpoint *Checkpoint) *outputReader {
+	return &outputReader{
+		zr:       zr,
+		offsets:  checkpoint.NextOffsets(),
+		advancer: checkpoint.advancer(),
+		builder:  zcode.NewBuilder(),
+	}
+}
+
+func (o *outputReader) Read() (*zed.Value, error) {
+	val, err := o.zr.Read()
+	if val == nil || err != nil {
+		return nil, err
+	}
+	o.records++
+	if named, ok := val.Type().(*zed.TypeNamed); ok && named.Name == "expired" {
+		// Expired records describe expired input records and,
+		// lacking a kafka field, are loaded as is.
+		return val, nil
+	}
+	if isDone(*val) {
+		o.n++
+		if _, _, err := o.advancer.advance(*val); err != nil {
+			return nil, err
+		}
+		return val, nil
+	}
+	out, err := o.assignOffset(*val)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// assignOffset returns val with its kafka.offset replaced by the next offset
+// of its kafka.topic.  The record is rewritten in place of formatting and
+// reparsing it, so its type is unchanged.
+func (o *outputReader) assignOffset(val zed.Value) (zed.Value, error) {
+	topic, _, err := getKafkaMeta(val)
+	if err != nil {
+		return zed.Null, err
+	}
+	typ := zed.TypeRecordOf(val.Type())
+	kafkaIndex, _ := typ.IndexOfField("kafka")
+	kafkaType := zed.TypeRecordOf(typ.Fields[kafkaIndex].Type)
+	offsetIndex, _ := kafkaType.IndexOfField("offset")
+	if id := zed.TypeUnder(kafkaType.Fields[offsetIndex].Type).ID(); id != zed.IDInt64 {
+		return zed.Null, fmt.Errorf("kafka.offset not an int64 in %q", zson.FormatValue(val))
+	}
+	offset := o.offsets[topic]
+	o.offsets[topic] = offset + 1
+	b := o.builder
+	b.Reset()
+	it := val.Bytes().Iter()
+	for k := 0; !it.Done(); k++ {
+		field := it.Next()
+		if k != kafkaIndex {
+			b.Append(field)
+			continue
+		}
+		b.BeginContainer()
+		kit := field.Iter()
+		for j := 0; !kit.Done(); j++ {
+			kafkaField := kit.Next()
+			if j == offsetIndex {
+				kafkaField = zed.EncodeInt(offset)
+			}
+			b.Append(kafkaField)
+		}
+		b.EndContainer()
+	}
+	out := zed.NewValue(val.Type(), b.Bytes())
+	if _, _, err := o.advancer.advance(out); err != nil {
+		return zed.Null, err
+	}
+	return out, nil
+}
+
+// checkpoint returns the output pool's checkpoint advanced past every record
+// read so far.
+func (o *outputReader) checkpoint() *Checkpoint {
+	return o.advancer.checkpoint()
+}
@@ -3,43 +3,40 @@ package etl
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/brimdata/zed"
-	"github.com/brimdata/zed/compiler"
 	lakeapi "github.com/brimdata/zed/lake/api"
-	"github.com/brimdata/zed/runtime"
-	"github.com/brimdata/zed/zbuf"
 	"github.com/brimdata/zed/zio"
-	"github.com/brimdata/zed/zio/zsonio"
 	"github.com/brimdata/zed/zson"
+	"github.com/segmentio/ksuid"
 )
 
 type Pipeline struct {
+	service    lakeapi.Interface
 	zctx       *zed.Context
 	transform  *Transform
 	outputPool *Pool
 	inputPools map[string]*Pool
 	cursors    map[string]int64
-	doneType   zed.Type
 }
 
 func NewPipeline(ctx context.Context, transform *Transform, service lakeapi.Interface) (*Pipeline, error) {
-	zctx := zed.NewContext()
-	doneType, err := zson.ParseType(zctx, "{kafka:{topic:string,offset:int64}}(=done)")
-	if err != nil {
-		return nil, err
-	}
 	p := &Pipeline{
-		zctx:       zctx,
+		service:    service,
+		zctx:       zed.NewContext(),
 		transform:  transform,
 		inputPools: make(map[string]*Pool),
 		cursors:    make(map[string]int64),
-		doneType:   doneType,
 	}
+	var err error
 	if p.outputPool, err = OpenPool(ctx, transform.Output.Pool, service); err != nil {
 		return nil, err
 	}
+	if branch := transform.Output.Branch; branch != "" {
+		if err := p.outputPool.UseBranch(ctx, branch); err != nil {
+			return nil, err
+		}
+	}
 	for _, route := range transform.Inputs {
 		name := route.Pool
 		if _, ok := p.inputPools[name]; ok {
@@ -54,113 +51,252 @@ func NewPipeline(ctx context.Context, transform *Transform, service lakeapi.Inte
 	return p, nil
 }
 
+// Run runs the transform and commits its output.  If another writer commits
+// to the output pool while the transform is running, Run discards the output
+// and runs the transform again against the new state of the output pool as
+// described for RetryConflicts.
 func (p *Pipeline) Run(ctx context.Context) (int, error) {
-	pool := p.getInputPool()
-	zeds, err := Build(p.transform)
+	var n int
+	err := RetryConflicts(ctx, func() error {
+		var err error
+		n, err = p.run(ctx)
+		return err
+	}, func(err error) {
+		fmt.Printf("%s: retrying\n", err)
+	})
+	return n, err
+}
+
+func (p *Pipeline) run(ctx context.Context) (int, error) {
+	// Note the output pool's head before the transform reads the output
+	// pool so a commit by another writer that the transform might see
+	// causes a conflict.
+	if err := p.outputPool.Rebase(ctx); err != nil {
+		return 0, err
+	}
+	checkpoint, err := p.outputPool.Checkpoint(ctx)
 	if err != nil {
 		return 0, err
 	}
-	if len(zeds) == 0 {
-		panic("no zed")
+	// Move the cursors up to the oldest unprocessed records before running
+	// the transform so it scans no more than it must.
+	cursors, err := p.nextCursors(ctx, p.buildOptions(checkpoint.CursorMap()))
+	if err != nil {
+		return 0, err
 	}
-	if len(zeds) != 1 {
-		panic("TBD: only one ETL works right now")
+	opts := p.buildOptions(cursors)
+	// Run the Zeds for every output topic in a single query against the
+	// same head commit of the output pool so all of their results land in
+	// a single commit.  The query names the pools it reads, so it runs
+	// outside the context of any one pool.
+	query, err := BuildQuery(p.transform, opts)
+	if err != nil {
+		return 0, err
 	}
-	batch, err := pool.Query(ctx, zeds[0])
+	zr, err := p.service.Query(ctx, nil, query)
 	if err != nil {
 		return 0, err
 	}
-	n := len(batch.Values())
-	if n > 0 {
-		err = p.writeToOutputPool(ctx, batch)
+	defer zr.Close()
+	r := newOutputReader(zr, checkpoint)
+	peeker := zio.NewPeeker(r)
+	if val, err := peeker.Peek(); val == nil || err != nil {
+		return 0, err
 	}
-	return n, err
-}
-
-func (p *Pipeline) getInputPool() *Pool {
-	for _, pool := range p.inputPools {
-		return pool
+	// This fails with ErrConflict if another writer has committed since
+	// the output pool was rebased.
+	commit, err := p.outputPool.LoadStream(ctx, p.zctx, peeker, func() (*Checkpoint, error) {
+		return r.checkpoint().WithCursors(cursors), nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	panic("no input pool")
+	fmt.Printf("commit %s %d record%s\n", commit, r.records, plural(r.records))
+	return r.n, nil
 }
 
-// XXX TBD: this is currently taking all records for an update in memory.
-// We need to work out a streaming model so we can do a very large updates
-// that could involve large anti-joins and spills and we stream the output
-// to the target pool.  This will scale fine since the anti-join design
-// allows any commits to be reliably accounted for on an interruption and restart.
-func (p *Pipeline) writeToOutputPool(ctx context.Context, batch *zbuf.Array) error {
-	offsets, err := p.outputPool.NextProducerOffsets(ctx)
+// nextCursors returns the cursors of the output pool as of the head commit
+// recorded by Rebase given the cursors in opts, which may lag behind.  Each
+// topic's cursor moves up to its oldest record not yet processed but never
+// past a gap in its offsets where a record may yet arrive, e.g., when
+// records are loaded out of order.  Gaps below a topic's settled offset
+// (see settledOffsets) are known to stay empty and are skipped.  A topic's
+// first cursor starts at its lowest offset.  The cursors are recorded by the
+// next commit, where they remain valid because the commit only adds done
+// records.
+func (p *Pipeline) nextCursors(ctx context.Context, opts Options) (map[string]int64, error) {
+	// The settled offsets must be read before the offsets so that every
+	// record below them is among the offsets.
+	settled, err := p.settledOffsets(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	out, err := insertOffsets(ctx, p.zctx, p.doneType, batch, offsets)
+	query, err := BuildOffsets(p.transform, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	next, err := contiguousOffsets(ctx, p.service, query, opts.Cursors, settled)
+	if err != nil {
+		return nil, err
 	}
-	for _, rec := range batch.Values() {
-		//XXX This still doesn't work with the zctx bug fix.  See issue #31
-		//if vals[k].Type == p.doneType {
-		//	out.Append(&vals[k])
-		//}
-		if named, ok := rec.Type().(*zed.TypeNamed); ok && named.Name == "done" {
-			out.Append(rec)
+	query, err = BuildPending(p.transform, opts)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := queryValues(ctx, p.service, query+"| offset:=min(offset) by topic\n")
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range vals {
+		topic, err := FieldAsString(val, "topic")
+		if err != nil {
+			return nil, err
 		}
-		if extra := rec.Deref("left"); extra != nil {
-			out.Append(*extra)
+		offset, err := FieldAsInt(val, "offset")
+		if err != nil {
+			return nil, err
 		}
-		if extra := rec.Deref("right"); extra != nil {
-			out.Append(*extra)
+		if cursor, ok := next[topic]; !ok || offset < cursor {
+			next[topic] = offset
 		}
 	}
-	//XXX We need to track the commitID and use new commit-only-if
-	// constraint and recompute offsets if needed.  See zync issue #16.
-	commit, err := p.outputPool.LoadBatch(ctx, p.zctx, out)
-	if err != nil {
-		return err
+	return next, nil
+}
+
+// settledOffsets returns, for each input topic whose pool's head commit
+// records a checkpoint, the next offset in that checkpoint.  The checkpoint
+// is recorded by zync from-kafka, which loads each topic in offset order, so
+// an offset below the topic's settled offset that is missing from the pool,
+// e.g., on a compacted or transactional topic, never arrives.
+func (p *Pipeline) settledOffsets(ctx context.Context) (map[string]int64, error) {
+	settled := make(map[string]int64)
+	pools := make(map[string]map[string]int64)
+	for _, route := range p.transform.Inputs {
+		branch := route.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		pool := p.inputPools[route.Pool]
+		ref := fmt.Sprintf("%s@%s", pool.ID(), branch)
+		offsets, ok := pools[ref]
+		if !ok {
+			head, err := p.service.CommitObject(ctx, pool.ID(), branch)
+			if err != nil {
+				return nil, err
+			}
+			if head != ksuid.Nil {
+				checkpoint, err := loadRecordedCheckpoint(ctx, p.service, pool.ID(), head)
+				if err != nil {
+					return nil, err
+				}
+				if checkpoint != nil {
+					offsets = checkpoint.NextOffsets()
+				}
+			}
+			pools[ref] = offsets
+		}
+		if offset, ok := offsets[route.Topic]; ok {
+			settled[route.Topic] = offset
+		}
 	}
-	batchLen := len(out.Values())
-	fmt.Printf("commit %s %d record%s\n", commit, batchLen, plural(batchLen))
-	return nil
+	return settled, nil
 }
 
-func insertOffsets(ctx context.Context, zctx *zed.Context, doneType zed.Type, batch zbuf.Batch, offsets map[string]int64) (*zbuf.Array, error) {
-	// It will be more efficient to compute the new kafka output offsets using
-	// flow count() but that is not implemented yet.  Instead, we just format
-	// up some ZSON that can then insert the proper offsets in each record.
-	var zsons strings.Builder
-	for _, rec := range batch.Values() {
-		// This pointer comparison should work but it doesn't right now.
-		// Are they all allocated in the same zctx?
-		//if vals[k].Type == doneType {
-		//	continue
-		//}
-		if named, ok := rec.Type().(*zed.TypeNamed); ok && named.Name == "done" {
-			continue
+// contiguousOffsets returns for each topic the offset following the run of
+// offsets yielded by query, in order, that starts at the topic's cursor or,
+// if it has none, at its lowest offset.  Missing offsets below the topic's
+// offset in settled do not end the run, and a run not ended by a gap
+// extends to the settled offset.
+func contiguousOffsets(ctx context.Context, service lakeapi.Interface, query string, cursors, settled map[string]int64) (map[string]int64, error) {
+	next := make(map[string]int64)
+	for topic, cursor := range cursors {
+		next[topic] = cursor
+	}
+	zr, err := service.Query(ctx, nil, query)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	gap := make(map[string]bool)
+	for {
+		val, err := zr.Read()
+		if err != nil {
+			return nil, err
 		}
-		if rec.Deref("left") != nil {
-			continue
+		if val == nil {
+			for topic, offset := range settled {
+				if cursor, ok := next[topic]; ok && !gap[topic] && cursor < offset {
+					next[topic] = offset
+				}
+			}
+			return next, nil
 		}
-		topic, _, err := getKafkaMeta(rec)
+		topic, err := FieldAsString(*val, "topic")
 		if err != nil {
 			return nil, err
 		}
-		off := offsets[topic]
-		zsons.WriteString(fmt.Sprintf("{rec:%s,offset:%d}\n", zson.FormatValue(rec), off))
-		offsets[topic] = off + 1
+		offset, err := FieldAsInt(*val, "offset")
+		if err != nil {
+			return nil, err
+		}
+		cursor, ok := next[topic]
+		switch {
+		case gap[topic]:
+		case !ok || offset == cursor || offset <= settled[topic]:
+			next[topic] = offset + 1
+		case offset > cursor:
+			gap[topic] = true
+		}
 	}
-	comp := compiler.NewCompiler()
-	program, err := comp.Parse("rec.kafka.offset:=offset | yield rec")
-	if err != nil {
-		return nil, err
+}
+
+// isDone returns whether val is a done record.
+func isDone(val zed.Value) bool {
+	//XXX This still doesn't work with the zctx bug fix.  See issue #31
+	//if val.Type == p.doneType {
+	//	return true
+	//}
+	named, ok := val.Type().(*zed.TypeNamed)
+	return ok && named.Name == "done"
+}
+
+// Merge validates the output pool's branch with the Zed query validate and
+// merges it into main as described for MergeBranch.
+func (p *Pipeline) Merge(ctx context.Context, validate string) (ksuid.KSUID, error) {
+	return p.outputPool.Merge(ctx, validate)
+}
+
+// Discard removes the output pool's branch unless it is main.
+func (p *Pipeline) Discard(ctx context.Context) error {
+	return p.outputPool.Discard(ctx)
+}
+
+// buildOptions returns the options for building the transform's Zed, which
+// refers to each pool by ID so that pools are resolved as they were by
+// NewPipeline, reads the output pool as of the head commit recorded by
+// Rebase, and scans each input topic from its cursor.
+func (p *Pipeline) buildOptions(cursors map[string]int64) Options {
+	unsorted := make(map[string]bool)
+	for name, pool := range p.inputPools {
+		if !pool.Sorted() {
+			unsorted[name] = true
+		}
 	}
-	reader := zsonio.NewReader(zctx, strings.NewReader(zsons.String()))
-	q, err := runtime.CompileQuery(ctx, zctx, comp, program, []zio.Reader{reader})
-	if err != nil {
-		return nil, err
+	if !p.outputPool.Sorted() {
+		unsorted[p.transform.Output.Pool] = true
+	}
+	refs := make(map[string]string)
+	for _, route := range p.transform.Inputs {
+		branch := route.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		refs[route.Topic] = fmt.Sprintf("%s@%q", p.inputPools[route.Pool].ID(), branch)
+	}
+	for _, route := range p.transform.OutputRoutes() {
+		refs[route.Topic] = p.outputPool.Ref()
 	}
-	defer q.Pull(true)
-	return NewArrayFromReader(zbuf.PullerReader(q))
+	return Options{Unsorted: unsorted, Refs: refs, Cursors: cursors}
 }
 
 func getKafkaMeta(rec zed.Value) (string, int64, error) {
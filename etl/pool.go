@@ -2,13 +2,12 @@ package etl
 
 import (
 	"context"
-	"errors"
 	"fmt"
 
 	"github.com/brimdata/zed"
-	"github.com/brimdata/zed/api"
 	lakeapi "github.com/brimdata/zed/lake/api"
-	"github.com/brimdata/zed/lakeparse"
+	"github.com/brimdata/zed/lake/data"
+	"github.com/brimdata/zed/lake/pools"
 	"github.com/brimdata/zed/order"
 	"github.com/brimdata/zed/pkg/field"
 	"github.com/brimdata/zed/zbuf"
@@ -21,63 +20,151 @@ import (
 // offset.
 const KafkaOffsetEarliest = -2
 
-var ErrBadPoolKey = errors.New("pool key must be 'kafka.offset' in ascending order")
-
 type Pool struct {
 	service lakeapi.Interface
 	pool    string
 	poolID  ksuid.KSUID
+	branch  string
+	sorted  bool        // whether the pool key is kafka.offset in ascending order
+	head    ksuid.KSUID // commit queried and loaded onto or ksuid.Nil for branch
+
+	checkpoint *Checkpoint // checkpoint as of head or nil if not yet loaded
 }
 
+// OpenPool opens the pool named or, failing that, identified by poolName.
 func OpenPool(ctx context.Context, poolName string, server lakeapi.Interface) (*Pool, error) {
-	pool, err := lakeapi.LookupPoolByName(ctx, server, poolName)
+	pool, err := LookupPool(ctx, server, poolName)
 	if err != nil {
 		return nil, err
 	}
-	// The sync algorithm relies on the pool key being kafka.offset asc.
-	if pool.SortKey.Order != order.Asc || len(pool.SortKey.Keys) == 0 || !pool.SortKey.Keys[0].Equal(field.Dotted("kafka.offset")) {
-		return nil, ErrBadPoolKey
-	}
 	return &Pool{
-		pool:    poolName,
+		pool:    pool.Name,
 		poolID:  pool.ID,
+		branch:  "main",
+		sorted:  SortedByOffset(pool.SortKey),
 		service: server,
 	}, nil
 }
 
-func (p *Pool) Query(ctx context.Context, src string) (*zbuf.Array, error) {
-	zr, err := p.service.Query(ctx, &lakeparse.Commitish{Pool: p.pool}, src)
+// LookupPool returns the configuration of the pool named or, failing that,
+// identified by nameOrID, so config files may refer to pools by ID when their
+// names are ambiguous or subject to change.
+func LookupPool(ctx context.Context, service lakeapi.Interface, nameOrID string) (*pools.Config, error) {
+	pool, err := lakeapi.LookupPoolByName(ctx, service, nameOrID)
 	if err != nil {
+		if id, parseErr := ksuid.Parse(nameOrID); parseErr == nil {
+			if pool, idErr := lakeapi.LookupPoolByID(ctx, service, id); idErr == nil {
+				return pool, nil
+			}
+		}
 		return nil, err
 	}
-	return NewArrayFromReader(zr)
+	return pool, nil
+}
+
+// SortedByOffset reports whether a pool with sortKey keeps its records in
+// kafka.offset order, letting queries of the pool rely on that order instead
+// of sorting.
+func SortedByOffset(sortKey order.SortKey) bool {
+	return sortKey.Order == order.Asc && len(sortKey.Keys) > 0 && sortKey.Keys[0].Equal(field.Dotted("kafka.offset"))
+}
+
+func (p *Pool) Name() string { return p.pool }
+
+func (p *Pool) ID() ksuid.KSUID { return p.poolID }
+
+// Ref returns a reference to the pool for a Zed from operator.  The
+// reference is to the head commit recorded by Rebase or, if the pool has not
+// been rebased or its branch has no commits, to the pool's branch.
+func (p *Pool) Ref() string {
+	if p.head != ksuid.Nil {
+		return fmt.Sprintf("%s@%q", p.poolID, p.head)
+	}
+	return fmt.Sprintf("%s@%q", p.poolID, p.branch)
+}
+
+// Sorted reports whether the pool is sorted by kafka.offset as described
+// for SortedByOffset.
+func (p *Pool) Sorted() bool { return p.sorted }
+
+// UseBranch directs queries and loads to branch, which is created from the
+// head of main if it does not exist.
+func (p *Pool) UseBranch(ctx context.Context, branch string) error {
+	if err := CreateBranchFromMain(ctx, p.service, p.poolID, branch); err != nil {
+		return err
+	}
+	p.branch = branch
+	p.head = ksuid.Nil
+	p.checkpoint = nil
+	return nil
+}
+
+// Discard removes the pool's branch unless it is main.
+func (p *Pool) Discard(ctx context.Context) error {
+	if p.branch == "main" {
+		return nil
+	}
+	return p.service.RemoveBranch(ctx, p.poolID, p.branch)
 }
 
-func (p *Pool) LoadBatch(ctx context.Context, zctx *zed.Context, batch *zbuf.Array) (ksuid.KSUID, error) {
-	return p.service.Load(ctx, zctx, p.poolID, "main", batch, api.CommitMessage{})
+// Merge validates the pool's branch and merges it into main as described
+// for MergeBranch.
+func (p *Pool) Merge(ctx context.Context, validate string) (ksuid.KSUID, error) {
+	commit, err := MergeBranch(ctx, p.service, p.pool, p.poolID, p.branch, validate)
+	p.branch = "main"
+	p.head = ksuid.Nil
+	p.checkpoint = nil
+	return commit, err
 }
 
-func (p *Pool) NextProducerOffsets(ctx context.Context) (map[string]int64, error) {
-	// Run a query against the pool to get the max output offset.
-	batch, err := p.Query(ctx, "offset:=max(kafka.offset) by topic:=kafka.topic")
+// Rebase records the head commit of the pool's branch.  Until the next
+// Rebase, Query reads the pool as of that commit and LoadStream commits only
+// if no other writer has committed since.
+func (p *Pool) Rebase(ctx context.Context) error {
+	head, err := p.service.CommitObject(ctx, p.poolID, p.branch)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// Note at start-up if there are no offsets, then we will return an empty
-	// map and the caller will get offset 0 for the next offset of any lookups.
-	offsets := make(map[string]int64)
-	for _, rec := range batch.Values() {
-		offset, err := FieldAsInt(rec, "offset")
+	p.head = head
+	p.checkpoint = nil
+	return nil
+}
+
+// LoadStream loads r onto the pool's branch in a single commit, so readers
+// of the branch see all of r at once.  Once r is exhausted, finish is called
+// to return the checkpoint recorded by the commit.  The commit is kept only
+// if the pool's branch has not changed since the head commit recorded by
+// Rebase or by the previous LoadStream.  Otherwise, LoadStream returns an
+// error wrapping ErrConflict.
+func (p *Pool) LoadStream(ctx context.Context, zctx *zed.Context, r zio.Reader, finish func() (*Checkpoint, error)) (ksuid.KSUID, error) {
+	var checkpoint *Checkpoint
+	commit, err := loadIfHead(ctx, p.service, zctx, p.poolID, p.branch, p.head, r, "", "", func() (string, error) {
+		var err error
+		checkpoint, err = finish()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		topic, err := FieldAsString(rec, "topic")
+		return checkpoint.Meta()
+	})
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	p.head = commit
+	p.checkpoint = checkpoint
+	return commit, nil
+}
+
+// Checkpoint returns the pool's checkpoint as of the commit recorded by
+// Rebase or by the previous LoadStream.
+func (p *Pool) Checkpoint(ctx context.Context) (*Checkpoint, error) {
+	if p.checkpoint == nil {
+		checkpoint, err := LoadCheckpoint(ctx, p.service, p.poolID, p.head)
 		if err != nil {
 			return nil, err
 		}
-		offsets[topic] = offset + 1
+		p.checkpoint = checkpoint
 	}
-	return offsets, nil
+	return p.checkpoint, nil
 }
 
 func NewArrayFromReader(zr zio.Reader) (*zbuf.Array, error) {
@@ -120,3 +207,31 @@ func FieldAsString(val zed.Value, field string) (string, error) {
 	}
 	return fieldVal.AsString(), nil
 }
+
+// CreatePool creates the pool named name with the pool key orderBy and the
+// target data object size thresh unless it already exists.  An empty orderBy
+// means kafka.offset in ascending order, and a zero thresh means the lake's
+// default.  CreatePool reports whether it created the pool.
+func CreatePool(ctx context.Context, service lakeapi.Interface, name, orderBy string, thresh int64) (bool, error) {
+	if _, err := LookupPool(ctx, service, name); err == nil {
+		return false, nil
+	}
+	if orderBy == "" {
+		orderBy = "kafka.offset:asc"
+	}
+	sortKey, err := order.ParseSortKey(orderBy)
+	if err != nil {
+		return false, err
+	}
+	if thresh == 0 {
+		thresh = data.DefaultThreshold
+	}
+	if _, err := service.CreatePool(ctx, name, sortKey, data.DefaultSeekStride, thresh); err != nil {
+		// Another process may have created the pool.
+		if _, lookupErr := lakeapi.LookupPoolByName(ctx, service, name); lookupErr == nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,274 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brimdata/zed/api"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/segmentio/ksuid"
+)
+
+// PruneOptions limit the processed input records deleted by Prune.
+type PruneOptions struct {
+	// If nonzero, only records committed to their input pool at least
+	// Age ago are deleted.
+	Age time.Duration
+	// If nonzero, the records of the Keep latest offsets of each input
+	// topic are kept.
+	Keep int64
+}
+
+// Pruned describes the records of an input topic deleted by Prune.
+type Pruned struct {
+	Pool    string
+	Topic   string
+	Through int64       // last offset deleted
+	Records int64       // number of records deleted
+	Commit  ksuid.KSUID // delete commit
+}
+
+// Prune deletes from the input pools of transform the records the transform
+// has already processed, so raw pools filled by from-kafka do not grow
+// without bound.  A record is deleted only if its offset and every earlier
+// offset of its topic in the input pool are covered by done records on the
+// main branch of the output pool, so the anti-join of the transform never
+// sees a deleted record as unprocessed.  The records are deleted with a
+// single delete-by-predicate commit per input pool, which carries the pool's
+// checkpoint so writers resume where they left off.  If another writer
+// commits to an input pool while Prune is working on it, Prune starts over
+// on that pool.
+func Prune(ctx context.Context, service lakeapi.Interface, transform *Transform, opts PruneOptions) ([]Pruned, error) {
+	type poolBranch struct {
+		pool   string
+		branch string
+	}
+	inputs := make(map[poolBranch][]string)
+	var keys []poolBranch
+	for _, route := range transform.Inputs {
+		branch := route.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		key := poolBranch{route.Pool, branch}
+		if _, ok := inputs[key]; !ok {
+			keys = append(keys, key)
+		}
+		inputs[key] = append(inputs[key], route.Topic)
+	}
+	output, err := lakeapi.LookupPoolByName(ctx, service, transform.Output.Pool)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []Pruned
+	for _, key := range keys {
+		pool, err := lakeapi.LookupPoolByName(ctx, service, key.pool)
+		if err != nil {
+			return nil, err
+		}
+		p := &pruner{
+			service:      service,
+			pool:         key.pool,
+			poolID:       pool.ID,
+			branch:       key.branch,
+			sorted:       SortedByOffset(pool.SortKey),
+			outputPool:   transform.Output.Pool,
+			outputSorted: SortedByOffset(output.SortKey),
+			opts:         opts,
+		}
+		var out []Pruned
+		err = RetryConflicts(ctx, func() error {
+			out, err = p.prune(ctx, inputs[key])
+			return err
+		}, func(err error) {
+			fmt.Printf("pool %s %s: retrying\n", key.pool, err)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", key.pool, err)
+		}
+		pruned = append(pruned, out...)
+	}
+	return pruned, nil
+}
+
+type pruner struct {
+	service      lakeapi.Interface
+	pool         string
+	poolID       ksuid.KSUID
+	branch       string
+	sorted       bool
+	outputPool   string
+	outputSorted bool
+	opts         PruneOptions
+}
+
+func (p *pruner) prune(ctx context.Context, topics []string) ([]Pruned, error) {
+	head, err := p.service.CommitObject(ctx, p.poolID, p.branch)
+	if err != nil || head == ksuid.Nil {
+		return nil, err
+	}
+	checkpoint, err := LoadCheckpoint(ctx, p.service, p.poolID, head)
+	if err != nil {
+		return nil, err
+	}
+	var aged map[string]int64
+	if p.opts.Age > 0 {
+		if aged, err = p.nextOffsetsAsOf(ctx, head, time.Now().Add(-p.opts.Age)); err != nil {
+			return nil, err
+		}
+	}
+	next := checkpoint.NextOffsets()
+	sort.Strings(topics)
+	var pruned []Pruned
+	var predicates []string
+	for _, topic := range topics {
+		through, ok, err := p.processedThrough(ctx, head, topic)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if aged != nil {
+			through = min(through, aged[topic]-1)
+		}
+		if p.opts.Keep > 0 {
+			through = min(through, next[topic]-1-p.opts.Keep)
+		}
+		if through < 0 {
+			continue
+		}
+		predicate := fmt.Sprintf("kafka.topic==%q and kafka.offset<=%d", topic, through)
+		n, err := p.count(ctx, head, predicate)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		pruned = append(pruned, Pruned{Pool: p.pool, Topic: topic, Through: through, Records: n})
+		predicates = append(predicates, "("+predicate+")")
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+	// If the checkpoint was computed from the pool's records instead of
+	// read from commit metadata, it may not cover all the deleted offsets,
+	// so extend it lest writers resync them.
+	covered := &Checkpoint{
+		Offsets: append([]PartitionOffset(nil), checkpoint.Offsets...),
+		Cursors: checkpoint.Cursors,
+		Holders: checkpoint.Holders,
+	}
+	for _, t := range pruned {
+		if next[t.Topic] <= t.Through {
+			covered.Offsets = append(covered.Offsets, PartitionOffset{Topic: t.Topic, Offset: t.Through})
+		}
+	}
+	meta, err := covered.Meta()
+	if err != nil {
+		return nil, err
+	}
+	var body strings.Builder
+	body.WriteString("prune processed records\n\n")
+	for _, t := range pruned {
+		fmt.Fprintf(&body, "  topic %s offsets through %d\n", t.Topic, t.Through)
+	}
+	message := api.CommitMessage{Body: body.String(), Meta: meta}
+	commit, err := commitIfHead(ctx, p.service, p.poolID, p.branch, head, func(private string) (ksuid.KSUID, error) {
+		return p.service.DeleteWhere(ctx, p.poolID, private, strings.Join(predicates, " or "), message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k := range pruned {
+		pruned[k].Commit = commit
+	}
+	return pruned, nil
+}
+
+// processedThrough returns the largest offset of topic such that it and
+// every earlier offset of topic in the input pool as of head are covered by
+// done records in the output pool.  The boolean result is false if no
+// offset is covered.
+func (p *pruner) processedThrough(ctx context.Context, head ksuid.KSUID, topic string) (int64, bool, error) {
+	var inSort, outSort string
+	if !p.sorted {
+		inSort = " | sort kafka.offset"
+	}
+	if !p.outputSorted {
+		outSort = " | sort kafka.offset"
+	}
+	query := fmt.Sprintf(`
+type done = {kafka:{topic:string,offset:int64}}
+from (
+  pool %s@%s => kafka.topic==%q%s
+  pool %q => is(<done>) kafka.topic==%q%s
+) | anti join on kafka.offset=kafka.offset
+| offset:=min(kafka.offset)
+| yield offset-1
+`, p.poolID, head, topic, inSort, p.outputPool, topic, outSort)
+	through, ok, err := p.queryInt(ctx, query)
+	if err != nil || ok {
+		return through, ok, err
+	}
+	// No record of topic is unprocessed, so every record up to the last
+	// done record is processed.
+	query = fmt.Sprintf(`
+type done = {kafka:{topic:string,offset:int64}}
+from %q | is(<done>) kafka.topic==%q | offset:=max(kafka.offset) | yield offset
+`, p.outputPool, topic)
+	return p.queryInt(ctx, query)
+}
+
+// nextOffsetsAsOf returns the next offset of each topic according to the
+// checkpoint of the latest commit in the history of head made no later
+// than t.
+func (p *pruner) nextOffsetsAsOf(ctx context.Context, head ksuid.KSUID, t time.Time) (map[string]int64, error) {
+	query := fmt.Sprintf("from %s@%s:log | has(id) date<=%s | head 1 | yield {id:ksuid(id)}", p.poolID, head, t.UTC().Format(time.RFC3339Nano))
+	vals, err := queryValues(ctx, p.service, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return map[string]int64{}, nil
+	}
+	s, err := FieldAsString(vals[0], "id")
+	if err != nil {
+		return nil, err
+	}
+	commit, err := ksuid.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := LoadCheckpoint(ctx, p.service, p.poolID, commit)
+	if err != nil {
+		return nil, err
+	}
+	return checkpoint.NextOffsets(), nil
+}
+
+func (p *pruner) count(ctx context.Context, head ksuid.KSUID, predicate string) (int64, error) {
+	query := fmt.Sprintf("from %s@%s | %s | n:=count() | yield int64(n)", p.poolID, head, predicate)
+	n, _, err := p.queryInt(ctx, query)
+	return n, err
+}
+
+// queryInt runs query, which must return at most one integer, and returns
+// the integer and whether one was returned.
+func (p *pruner) queryInt(ctx context.Context, query string) (int64, bool, error) {
+	vals, err := queryValues(ctx, p.service, query)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(vals) == 0 || vals[0].IsNull() {
+		return 0, false, nil
+	}
+	if len(vals) != 1 {
+		return 0, false, fmt.Errorf("query returned %d values instead of one: %s", len(vals), query)
+	}
+	return vals[0].AsInt(), true, nil
+}
@@ -0,0 +1,134 @@
+package etl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/api"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/zio"
+	"github.com/brimdata/zed/zio/zngio"
+	"github.com/segmentio/ksuid"
+)
+
+// The API of a Zed lake service has no conditional commit, so for a lake
+// reached through one, the conditional commits fall back to checking the
+// branch head before committing and, if the new commit turns out not to
+// follow that head because another writer got in between, reverting it.
+// Readers may then briefly see the reverted commit.
+
+var remoteWarning sync.Once
+
+func warnRemote() {
+	remoteWarning.Do(func() {
+		fmt.Fprintln(os.Stderr, "warning: the lake is reached through a lake service, which has no conditional commit, so a commit that conflicts with another writer's is reverted after the fact and may briefly be seen by readers; use the lake's path for atomic commits")
+	})
+}
+
+// loadIfHeadRemote is loadIfHead for a lake service.
+func loadIfHeadRemote(ctx context.Context, service lakeapi.Interface, zctx *zed.Context, poolID ksuid.KSUID, branch string, head ksuid.KSUID, r zio.Reader, author, body string, meta func() (string, error)) (ksuid.KSUID, error) {
+	warnRemote()
+	if err := checkHeadRemote(ctx, service, poolID, branch, head); err != nil {
+		return ksuid.Nil, err
+	}
+	// The metadata, known only once r is exhausted, goes ahead of the data
+	// in a load request, so r is spooled to a temporary file first.
+	f, err := os.CreateTemp("", "zync-load-*.zng")
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := zngio.NewWriter(zio.NopCloser(f))
+	err = zio.CopyWithContext(ctx, w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	s, err := meta()
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ksuid.Nil, err
+	}
+	zr := zngio.NewReader(zctx, f)
+	defer zr.Close()
+	id, err := service.Load(ctx, zctx, poolID, branch, zr, api.CommitMessage{Author: author, Body: body, Meta: s})
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	return id, revertUnlessParent(ctx, service, poolID, branch, head, id)
+}
+
+// commitIfHeadRemote is commitIfHead for a lake service.  The commit is made
+// directly on branch.
+func commitIfHeadRemote(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID, commit func(branch string) (ksuid.KSUID, error)) (ksuid.KSUID, error) {
+	warnRemote()
+	if err := checkHeadRemote(ctx, service, poolID, branch, head); err != nil {
+		return ksuid.Nil, err
+	}
+	id, err := commit(branch)
+	if err != nil {
+		return ksuid.Nil, err
+	}
+	return id, revertUnlessParent(ctx, service, poolID, branch, head, id)
+}
+
+// fastForwardRemote is lakePool.fastForward for a lake service.  As the API
+// cannot move a branch, branch is removed and created again at to, so a
+// reader may briefly find branch missing.
+func fastForwardRemote(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, from, to ksuid.KSUID) error {
+	warnRemote()
+	if err := checkHeadRemote(ctx, service, poolID, branch, from); err != nil {
+		return err
+	}
+	if err := service.RemoveBranch(ctx, poolID, branch); err != nil {
+		return err
+	}
+	return service.CreateBranch(context.WithoutCancel(ctx), poolID, branch, to)
+}
+
+// checkHeadRemote returns an error wrapping ErrConflict if branch is not at
+// head.
+func checkHeadRemote(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID) error {
+	current, err := service.CommitObject(ctx, poolID, branch)
+	if err != nil {
+		return err
+	}
+	if current != head {
+		return fmt.Errorf("%w: expected head %s but found %s", ErrConflict, head, current)
+	}
+	return nil
+}
+
+// revertUnlessParent reverts commit, just made to branch, unless its parent
+// is head, in which case no other writer's commit got in first, and returns
+// an error wrapping ErrConflict if it reverted commit.
+func revertUnlessParent(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head, commit ksuid.KSUID) error {
+	query := fmt.Sprintf("from %s@%q:log | has(id) ksuid(id)==%q | yield {parent:string(ksuid(parent))}", poolID, branch, commit)
+	vals, err := queryValues(ctx, service, query)
+	if err != nil {
+		return err
+	}
+	if len(vals) == 1 {
+		parent, err := FieldAsString(vals[0], "parent")
+		if err != nil {
+			return err
+		}
+		if parent == head.String() {
+			return nil
+		}
+	}
+	message := api.CommitMessage{Body: fmt.Sprintf("revert commit %s, which conflicted with another writer", commit)}
+	if _, err := service.Revert(context.WithoutCancel(ctx), poolID, branch, commit, message); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: expected commit %s to follow %s", ErrConflict, commit, head)
+}
@@ -2,28 +2,45 @@ package etl
 
 import (
 	"fmt"
+	"sort"
 )
 
 type Routes struct {
-	pools   map[string]string   // any topic to pool
-	inputs  map[string][]string // output topics of the input
-	outputs map[string][]string // input topics of the output
+	pools    map[string]string   // any topic to pool
+	branches map[string]string   // any topic to branch of its pool
+	inputs   map[string][]string // output topics of the input
+	outputs  map[string][]string // input topics of the output
+	isOutput map[string]bool     // whether a topic has an output route
 }
 
 func newRoutes(transform *Transform) (*Routes, error) {
+	for _, route := range transform.Outputs {
+		if route.Pool != "" && route.Pool != transform.Output.Pool {
+			return nil, fmt.Errorf("output topic %q must be in output pool %q", route.Topic, transform.Output.Pool)
+		}
+	}
 	pools := make(map[string]string)
-	all := make([]Route, 0, len(transform.Inputs)+1)
-	all = append(append(all, transform.Inputs...), transform.Output)
+	branches := make(map[string]string)
+	isOutput := make(map[string]bool)
+	outputs := transform.OutputRoutes()
+	for _, route := range outputs {
+		isOutput[route.Topic] = true
+	}
+	all := make([]Route, 0, len(transform.Inputs)+len(outputs))
+	all = append(append(all, transform.Inputs...), outputs...)
 	for _, route := range all {
 		if _, ok := pools[route.Topic]; ok {
 			return nil, fmt.Errorf("route for topic %q points to multiple pools", route.Topic)
 		}
 		pools[route.Topic] = route.Pool
+		branches[route.Topic] = route.Branch
 	}
 	return &Routes{
-		pools:   pools,
-		inputs:  make(map[string][]string),
-		outputs: make(map[string][]string),
+		pools:    pools,
+		branches: branches,
+		inputs:   make(map[string][]string),
+		outputs:  make(map[string][]string),
+		isOutput: isOutput,
 	}, nil
 }
 
@@ -31,11 +48,32 @@ func (r *Routes) LookupPool(topic string) string {
 	return r.pools[topic]
 }
 
+// LookupPoolRef returns a Zed reference to the pool and branch of topic
+// suitable for a from operator.
+func (r *Routes) LookupPoolRef(topic string) string {
+	if branch := r.branches[topic]; branch != "" && branch != "main" {
+		return fmt.Sprintf("%q@%q", r.pools[topic], branch)
+	}
+	return fmt.Sprintf("%q", r.pools[topic])
+}
+
+// Outputs returns the output topics entered by ETLs in sorted order.
 func (r *Routes) Outputs() []string {
 	topics := make([]string, 0, len(r.outputs))
 	for topic := range r.outputs {
 		topics = append(topics, topic)
 	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Inputs returns the input topics entered by ETLs in sorted order.
+func (r *Routes) Inputs() []string {
+	topics := make([]string, 0, len(r.inputs))
+	for topic := range r.inputs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
 	return topics
 }
 
@@ -54,8 +92,8 @@ func (r *Routes) enter(input, output string) error {
 	if err := r.checkpool(input); err != nil {
 		return err
 	}
-	if err := r.checkpool(output); err != nil {
-		return err
+	if !r.isOutput[output] {
+		return fmt.Errorf("topic %q is not an output topic", output)
 	}
 	if !stringIn(input, r.outputs[output]) {
 		r.outputs[output] = append(r.outputs[output], input)
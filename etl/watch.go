@@ -0,0 +1,42 @@
+package etl
+
+import (
+	"context"
+	"time"
+
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// MinPollInterval and MaxPollInterval bound the interval between polls
+	// of a branch by WaitForCommit.
+	MinPollInterval = 100 * time.Millisecond
+	MaxPollInterval = 5 * time.Second
+)
+
+// WaitForCommit polls the branch of a pool until its head commit differs
+// from head and returns the new head commit.  The interval between polls
+// starts at MinPollInterval and doubles up to MaxPollInterval.  Polling is
+// used rather than the lake service's event stream since it works the same
+// for local and remote lakes.
+func WaitForCommit(ctx context.Context, service lakeapi.Interface, poolID ksuid.KSUID, branch string, head ksuid.KSUID) (ksuid.KSUID, error) {
+	interval := MinPollInterval
+	for {
+		commit, err := service.CommitObject(ctx, poolID, branch)
+		if err != nil {
+			return ksuid.Nil, err
+		}
+		if commit != head {
+			return commit, nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ksuid.Nil, ctx.Err()
+		}
+		if interval *= 2; interval > MaxPollInterval {
+			interval = MaxPollInterval
+		}
+	}
+}
@@ -1,20 +1,45 @@
 package etl
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"io/ioutil"
+	"regexp"
+	"unicode"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Transform struct {
 	Inputs []Route `yaml:"inputs"`
 	Output Route   `yaml:"output"`
-	ETLs   []Rule  `yaml:"transforms"`
+	// Outputs lists any further output topics.  They are written to the
+	// pool and branch of Output, so their pool and branch may be omitted.
+	Outputs []Route `yaml:"outputs"`
+	ETLs    []Rule  `yaml:"transforms"`
+}
+
+// OutputRoutes returns the routes of all output topics of t, each with the
+// pool and branch of t.Output.
+func (t *Transform) OutputRoutes() []Route {
+	routes := []Route{t.Output}
+	for _, r := range t.Outputs {
+		r.Pool = t.Output.Pool
+		r.Branch = t.Output.Branch
+		routes = append(routes, r)
+	}
+	return routes
 }
 
 type Route struct {
-	Topic string `yaml:"topic"`
-	Pool  string `yaml:"pool"`
+	Topic  string `yaml:"topic"`
+	Pool   string `yaml:"pool"`
+	Branch string `yaml:"branch"` // branch of pool if not main
+
+	// These configure the pool if it is created by zync.
+	OrderBy string `yaml:"orderby"` // pool key, e.g., "ts:desc"
+	Thresh  string `yaml:"thresh"`  // target data object size, e.g., "500MB"
 }
 
 type Rule struct {
@@ -26,16 +51,94 @@ type Rule struct {
 	Out   string `yaml:"out"`
 	Where string `yaml:"where"`
 	Zed   string `yaml:"zed"`
+	// These configure the expiry of records of a left and right denorm
+	// rule that remain unmatched for longer than Timeout or, for a denorm
+	// rule with tables, how long rows unmatched by a left join are held.
+	Timeout  string `yaml:"timeout"`  // e.g., "1h"; records never expire if empty
+	Time     string `yaml:"time"`     // time of a record, time(value.ts_ms*1000000) if empty
+	Fallback string `yaml:"fallback"` // Zed creating out from an expired record in, if any
+	// Tables configures a denorm rule joining more than two topics in
+	// place of Left, Right, and Join.
+	Tables []Table `yaml:"tables"`
+	// These configure a transaction rule, whose In is the Debezium
+	// transaction metadata topic.
+	Topics []string `yaml:"topics"` // topics of the events of the transactions
+	TxID   string   `yaml:"txid"`   // transaction ID of an event, value.transaction.id if empty
+	// These configure a materialize rule.
+	Key  string `yaml:"key"`  // primary key expression, "key" if empty
+	Sink string `yaml:"sink"` // topic for JDBC sink records if not empty
+}
+
+// Table is a topic joined by a denorm rule with the topics of the tables
+// listed before it.
+type Table struct {
+	Topic string `yaml:"topic"`
+	As    string `yaml:"as"`      // field holding the topic's record, the topic if empty
+	Join  string `yaml:"join"`    // "inner" (the default) or "left" for a left outer join
+	On    string `yaml:"join-on"` // join condition, e.g., order.value.after.ID=line.value.after.OrderID
+}
+
+// Field returns the name of the field holding the table's record, which
+// must be a Zed identifier (see isIdentifier) so the rule's Zed can refer to
+// it, e.g., as order.value.after.ID.
+func (t Table) Field() string {
+	if t.As != "" {
+		return t.As
+	}
+	return t.Topic
 }
 
+// isIdentifier returns whether s can be used as a field name in Zed without
+// quoting.
+func isIdentifier(s string) bool {
+	for k, r := range s {
+		if r != '_' && r != '$' && !unicode.IsLetter(r) && (k == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Outputs returns the output topics r lands on.
+func (r Rule) Outputs() []string {
+	if r.Sink != "" {
+		return []string{r.Out, r.Sink}
+	}
+	return []string{r.Out}
+}
+
+// Load reads the config file at path into t.  A key that configures nothing,
+// e.g., a misspelled one, is an error giving its line.
 func (t *Transform) Load(path string) error {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(b, t)
+	return decode(b, t)
 }
 
+// decode decodes the YAML in b into t, failing with a *yaml.TypeError on keys
+// that are not the yaml tag of a field.  The fields of other keys are set
+// all the same.
+func decode(b []byte, t *Transform) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(t); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for k, msg := range typeErr.Errors {
+				typeErr.Errors[k] = unknownFieldRE.ReplaceAllString(msg, "unknown key $1")
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// unknownFieldRE matches the decoder's error for an unknown key, which names
+// the Go type rather than anything in the config file.
+var unknownFieldRE = regexp.MustCompile(`field (\S+) not found in type \S+$`)
+
 func Load(path string) (*Transform, error) {
 	var t Transform
 	if err := t.Load(path); err != nil {
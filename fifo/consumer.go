@@ -79,6 +79,17 @@ func (c *Consumer) Close() {
 	c.kclient.Close()
 }
 
+// Pause stops fetching records from topics until they are resumed.
+// Records already fetched are still returned by ReadValue.
+func (c *Consumer) Pause(topics ...string) {
+	c.kclient.PauseFetchTopics(topics...)
+}
+
+// Resume resumes fetching records from topics paused by Pause.
+func (c *Consumer) Resume(topics ...string) {
+	c.kclient.ResumeFetchTopics(topics...)
+}
+
 // ReadValue returns the next value.  Unlike zio.Reader.Read, the caller
 // receives ownership of zed.Value.Bytes.
 func (c *Consumer) ReadValue(ctx context.Context) (zed.Value, error) {
@@ -4,14 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/brimdata/zed"
 	"github.com/brimdata/zed/api"
 	"github.com/brimdata/zed/compiler"
 	lakeapi "github.com/brimdata/zed/lake/api"
 	"github.com/brimdata/zed/lakeparse"
-	"github.com/brimdata/zed/order"
-	"github.com/brimdata/zed/pkg/field"
 	"github.com/brimdata/zed/runtime"
 	"github.com/brimdata/zed/zbuf"
 	"github.com/brimdata/zed/zio"
@@ -19,70 +18,371 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
-var ErrBadPoolKey = errors.New("pool key must be 'kafka.offset' in ascending order")
-
 type Lake struct {
 	service lakeapi.Interface
 	shaper  string
 	pool    string
 	poolID  ksuid.KSUID
+	branch  string
+	sorted  bool             // whether the pool key is kafka.offset in ascending order
+	thresh  int64            // target data object size of the pool
+	offsets map[string]int64 // next expected offset of each topic
+	gaps    []Gap            // gaps not yet recorded in a commit
+	head    ksuid.KSUID      // commit queried and loaded onto or ksuid.Nil for branch
+	leases  []*Lease         // leases loads require
+
+	checkpoint *etl.Checkpoint // checkpoint as of head or nil if not rebased
+}
+
+// Gap is a range of offsets missing from a Kafka topic.  Gaps occur on
+// compacted topics and on topics written transactionally, where commit
+// markers take up offsets.
+type Gap struct {
+	Topic string
+	Start int64 // first missing offset
+	End   int64 // last missing offset
+}
+
+func (g Gap) String() string {
+	return fmt.Sprintf("topic %s offsets %d-%d", g.Topic, g.Start, g.End)
 }
 
 func NewLake(ctx context.Context, poolName, shaper string, server lakeapi.Interface) (*Lake, error) {
-	pool, err := lakeapi.LookupPoolByName(ctx, server, poolName)
+	pool, err := etl.LookupPool(ctx, server, poolName)
 	if err != nil {
 		return nil, err
 	}
-	// The sync algorithm relies on the pool key being kafka.offset asc.
-	if pool.SortKey.Order != order.Asc || len(pool.SortKey.Keys) == 0 || !pool.SortKey.Keys[0].Equal(field.Dotted("kafka.offset")) {
-		return nil, ErrBadPoolKey
-	}
 	return &Lake{
-		pool:    poolName,
+		pool:    pool.Name,
 		poolID:  pool.ID,
+		branch:  "main",
+		sorted:  etl.SortedByOffset(pool.SortKey),
+		thresh:  pool.Threshold,
 		service: server,
 		shaper:  shaper,
+		offsets: make(map[string]int64),
 	}, nil
 }
 
 func (l *Lake) Pool() string { return l.pool }
 
+// UseBranch directs queries and loads to branch, which is created from the
+// head of main if it does not exist.
+func (l *Lake) UseBranch(ctx context.Context, branch string) error {
+	if err := etl.CreateBranchFromMain(ctx, l.service, l.poolID, branch); err != nil {
+		return err
+	}
+	l.branch = branch
+	l.head = ksuid.Nil
+	l.checkpoint = nil
+	return nil
+}
+
+func (l *Lake) Branch() string { return l.branch }
+
+// Discard removes the pool's branch unless it is main.
+func (l *Lake) Discard(ctx context.Context) error {
+	if l.branch == "main" {
+		return nil
+	}
+	return l.service.RemoveBranch(ctx, l.poolID, l.branch)
+}
+
+// Merge validates the pool's branch with the Zed query validate and merges
+// it into main as described for etl.MergeBranch.
+func (l *Lake) Merge(ctx context.Context, validate string) (ksuid.KSUID, error) {
+	commit, err := etl.MergeBranch(ctx, l.service, l.pool, l.poolID, l.branch, validate)
+	l.branch = "main"
+	l.head = ksuid.Nil
+	l.checkpoint = nil
+	return commit, err
+}
+
+// Head returns the head commit of the pool's branch.
+func (l *Lake) Head(ctx context.Context) (ksuid.KSUID, error) {
+	return l.service.CommitObject(ctx, l.poolID, l.branch)
+}
+
+// WaitForCommit waits for the head commit of the pool's branch to differ
+// from head and returns the new head.
+func (l *Lake) WaitForCommit(ctx context.Context, head ksuid.KSUID) (ksuid.KSUID, error) {
+	return etl.WaitForCommit(ctx, l.service, l.poolID, l.branch, head)
+}
+
+// Rebase records the head commit of the pool's branch and loads the
+// pool's checkpoint as of that commit.  Until the next Rebase, Query reads
+// the pool as of that commit and LoadBatch bases its commits on it.
+func (l *Lake) Rebase(ctx context.Context) error {
+	head, err := l.Head(ctx)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := etl.LoadCheckpoint(ctx, l.service, l.poolID, head)
+	if err != nil {
+		return err
+	}
+	l.head = head
+	l.checkpoint = checkpoint
+	return nil
+}
+
 func (l *Lake) Query(ctx context.Context, src string) (*zbuf.Array, error) {
-	zr, err := l.service.Query(ctx, &lakeparse.Commitish{Pool: l.pool}, src)
+	commitish := &lakeparse.Commitish{Pool: l.pool, Branch: l.branch}
+	if l.head != ksuid.Nil {
+		commitish.Branch = l.head.String()
+	}
+	zr, err := l.service.Query(ctx, commitish, src)
 	if err != nil {
 		return nil, err
 	}
 	return etl.NewArrayFromReader(zr)
 }
 
-func (l *Lake) LoadBatch(ctx context.Context, zctx *zed.Context, batch *zbuf.Array) (ksuid.KSUID, error) {
-	return l.service.Load(ctx, zctx, l.poolID, "main", batch, api.CommitMessage{})
+// RequireLease makes loads by l require lease, which must be held.  It
+// commits no data but records the holder of lease in the pool's checkpoint.
+// Each load then checks the checkpoint it is based on and fails with
+// ErrLeaseLost if another writer has since recorded itself as the holder,
+// and since loads are conditional on the head commit, a writer that takes
+// lease over cannot be overwritten by a writer that has yet to find out.
+func (l *Lake) RequireLease(ctx context.Context, lease *Lease) error {
+	var rebase bool
+	err := etl.RetryConflicts(ctx, func() error {
+		if l.checkpoint == nil || rebase {
+			if err := l.Rebase(ctx); err != nil {
+				return err
+			}
+		}
+		if l.checkpoint.Holder(lease.key) == lease.owner {
+			return nil
+		}
+		checkpoint := l.checkpoint.WithHolder(lease.key, lease.owner)
+		meta, err := checkpoint.Meta()
+		if err != nil {
+			return err
+		}
+		message := api.CommitMessage{
+			Author: lease.owner,
+			Body:   fmt.Sprintf("hold lease %s", lease.key),
+			Meta:   meta,
+		}
+		commit, err := etl.CommitMetaIfHead(ctx, l.service, l.poolID, l.branch, l.head, message)
+		if err != nil {
+			return err
+		}
+		l.head = commit
+		l.checkpoint = checkpoint
+		return nil
+	}, func(error) {
+		rebase = true
+	})
+	if err != nil {
+		return err
+	}
+	l.leases = append(l.leases, lease)
+	return nil
 }
 
-func (l *Lake) NextConsumerOffset(ctx context.Context, topic string) (int64, error) {
-	// Find the largest offset for the given topic.  Since these
-	// values are monotonically increasing, we can just do "tail 1".
-	query := fmt.Sprintf("kafka.topic=='%s' | tail 1 | yield kafka", topic)
-	batch, err := l.Query(ctx, query)
+// checkLeases returns an error wrapping ErrLeaseLost if the checkpoint names
+// another holder for any lease l requires.
+func (l *Lake) checkLeases() error {
+	for _, lease := range l.leases {
+		if owner := l.checkpoint.Holder(lease.key); owner != lease.owner {
+			return fmt.Errorf("%w: %s held by %s", ErrLeaseLost, lease, owner)
+		}
+	}
+	return nil
+}
+
+// LoadBatch commits the records of batch that are not already in the pool,
+// according to its checkpoint, and returns the commit and the number of
+// records committed.  The commit's metadata records the pool's new
+// checkpoint, and any gaps found by TrackOffsets since the last commit are
+// recorded in the commit message.  If another writer has committed to the
+// pool since the head commit recorded by Rebase or by the previous LoadBatch,
+// LoadBatch rebases onto the new head, drops any records the other writer
+// committed, and tries again as described for etl.RetryConflicts.  LoadBatch
+// fails without committing if the checkpoint it is based on shows that a
+// lease passed to RequireLease was taken over.
+func (l *Lake) LoadBatch(ctx context.Context, zctx *zed.Context, batch *zbuf.Array) (ksuid.KSUID, int, error) {
+	if l.checkpoint == nil {
+		if err := l.Rebase(ctx); err != nil {
+			return ksuid.Nil, 0, err
+		}
+	}
+	var commit ksuid.KSUID
+	var n int
+	var rebase bool
+	err := etl.RetryConflicts(ctx, func() error {
+		if rebase {
+			if err := l.Rebase(ctx); err != nil {
+				return err
+			}
+		}
+		if err := l.checkLeases(); err != nil {
+			return err
+		}
+		vals, err := dropLoaded(batch.Values(), l.checkpoint.NextOffsets())
+		if err != nil {
+			return err
+		}
+		n = len(vals)
+		if n == 0 {
+			commit = ksuid.Nil
+			return nil
+		}
+		checkpoint, err := l.checkpoint.Advance(vals)
+		if err != nil {
+			return err
+		}
+		meta, err := checkpoint.Meta()
+		if err != nil {
+			return err
+		}
+		message := api.CommitMessage{Meta: meta}
+		if len(l.gaps) > 0 {
+			var b strings.Builder
+			fmt.Fprintf(&b, "loaded %d record%s\n\noffset gaps:\n", n, plural(n))
+			for _, gap := range l.gaps {
+				fmt.Fprintf(&b, "  %s\n", gap)
+			}
+			message.Body = b.String()
+		}
+		commit, err = etl.LoadIfHead(ctx, l.service, zctx, l.poolID, l.branch, l.head, zbuf.NewArray(vals), message)
+		if err != nil {
+			return err
+		}
+		l.head = commit
+		l.checkpoint = checkpoint
+		l.gaps = nil
+		return nil
+	}, func(err error) {
+		fmt.Printf("pool %s %s: retrying\n", l.pool, err)
+		rebase = true
+	})
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	return commit, n, nil
+}
+
+// Compact merges the small data objects of the pool's branch into larger
+// ones as described for etl.CompactIfHead and returns the compaction commit
+// and the number of objects compacted.  If another writer has committed to
+// the pool since the head commit recorded by Rebase or by the previous
+// LoadBatch, Compact rebases onto the new head and skips compaction until
+// it is called again.
+func (l *Lake) Compact(ctx context.Context) (ksuid.KSUID, int, error) {
+	if l.checkpoint == nil {
+		if err := l.Rebase(ctx); err != nil {
+			return ksuid.Nil, 0, err
+		}
+	}
+	commit, n, err := etl.CompactIfHead(ctx, l.service, l.poolID, l.branch, l.head, l.checkpoint, l.thresh)
+	if errors.Is(err, etl.ErrConflict) {
+		return ksuid.Nil, 0, l.Rebase(ctx)
+	}
+	if err != nil {
+		return ksuid.Nil, 0, err
+	}
+	if commit != ksuid.Nil {
+		l.head = commit
+	}
+	return commit, n, nil
+}
+
+// dropLoaded returns the values in vals whose offsets are not below the
+// next offset of their topic in next.
+func dropLoaded(vals []zed.Value, next map[string]int64) ([]zed.Value, error) {
+	var out []zed.Value
+	for _, val := range vals {
+		topic, offset, err := kafkaTopicAndOffset(val)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= next[topic] {
+			out = append(out, val)
+		}
+	}
+	return out, nil
+}
+
+func kafkaTopicAndOffset(val zed.Value) (string, int64, error) {
+	kafka, err := etl.Field(val, "kafka")
 	if err != nil {
-		return etl.KafkaOffsetEarliest, err
+		return "", 0, err
 	}
-	vals := batch.Values()
-	if n := len(vals); n == 0 {
+	topic, err := etl.FieldAsString(kafka, "topic")
+	if err != nil {
+		return "", 0, err
+	}
+	offset, err := etl.FieldAsInt(kafka, "offset")
+	if err != nil {
+		return "", 0, err
+	}
+	return topic, offset, nil
+}
+
+// TrackOffsets advances the next expected offset of each topic in batch,
+// which must be in offset order for each topic, and returns any gaps found.
+// The gaps are also recorded in the message of the next commit by LoadBatch.
+func (l *Lake) TrackOffsets(batch zbuf.Batch) ([]Gap, error) {
+	var gaps []Gap
+	for _, val := range batch.Values() {
+		topic, offset, err := kafkaTopicAndOffset(val)
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := l.offsets[topic]; ok && offset > next {
+			gaps = append(gaps, Gap{Topic: topic, Start: next, End: offset - 1})
+		}
+		l.offsets[topic] = offset + 1
+	}
+	l.gaps = append(l.gaps, gaps...)
+	return gaps, nil
+}
+
+// NextConsumerOffset returns the offset from which to consume topic, which
+// is the offset following the last offset of topic in the pool according
+// to its checkpoint, or etl.KafkaOffsetEarliest if the pool has no records
+// from topic.
+func (l *Lake) NextConsumerOffset(ctx context.Context, topic string) (int64, error) {
+	if l.checkpoint == nil {
+		if err := l.Rebase(ctx); err != nil {
+			return etl.KafkaOffsetEarliest, err
+		}
+	}
+	next, ok := l.checkpoint.NextOffsets()[topic]
+	if !ok {
 		return etl.KafkaOffsetEarliest, nil
-	} else if n > 1 {
-		// This should not happen.
-		return 0, errors.New("'tail 1' returned more than one record")
 	}
-	offset, err := etl.FieldAsInt(vals[0], "offset")
+	l.offsets[topic] = next
+	return next, nil
+}
+
+// Topics returns the distinct kafka.topic values in the pool.
+func (l *Lake) Topics(ctx context.Context) ([]string, error) {
+	batch, err := l.Query(ctx, "has(kafka.topic) | count() by topic:=kafka.topic | sort topic")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return offset + 1, nil
+	var topics []string
+	for _, val := range batch.Values() {
+		topic, err := etl.FieldAsString(val, "topic")
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
 }
 
 func (l *Lake) ReadBatch(ctx context.Context, topic string, offset int64, size int) (zbuf.Batch, error) {
-	query := fmt.Sprintf("kafka.topic=='%s' kafka.offset >= %d | head %d", topic, offset, size)
+	query := fmt.Sprintf("kafka.topic=='%s' kafka.offset >= %d", topic, offset)
+	if !l.sorted {
+		// Find the records following offset before taking the batch.
+		query += " | sort kafka.offset"
+	}
+	query += fmt.Sprintf(" | head %d", size)
 	if l.shaper != "" {
 		query = fmt.Sprintf("%s | %s  | sort kafka.offset", query, l.shaper)
 	} else {
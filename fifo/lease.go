@@ -0,0 +1,228 @@
+package fifo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/brimdata/zed/api"
+	"github.com/brimdata/zed/pkg/nano"
+	"github.com/brimdata/zed/zson"
+	"github.com/brimdata/zync/etl"
+	"github.com/segmentio/ksuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// LeaseBranch is the pool branch to which leases are committed.  Leases are
+// kept off the main branch so they never mix with synced data.
+const LeaseBranch = "zync-leases"
+
+var (
+	ErrLeaseHeld = errors.New("lease held by another writer")
+	ErrLeaseLost = errors.New("lease lost to another writer")
+)
+
+// Lease fences off concurrent writers to a pool or topic.  A writer acquires
+// the lease for a key before writing and keeps renewing it while writing.
+// Another writer cannot acquire the lease until the holder releases it or
+// lets it expire.
+//
+// The leases of a pool are kept in the metadata of the single commit of
+// LeaseBranch, which each acquisition, renewal, or release replaces with a
+// conditional commit (see etl.ReplaceMeta).  Of two writers racing to take
+// over a lease, only one commit succeeds; the other writer reads the leases
+// again and finds the lease held.  The branch keeps no history, so a lease
+// operation reads only the current leases.
+//
+// A lease by itself only keeps well-behaved writers apart: a writer that
+// stalls past the lease's TTL may resume writing before it finds out, at
+// its next renewal, that the lease was taken over.  Writers to a pool close
+// this gap with Lake.RequireLease.
+type Lease struct {
+	lake  *Lake
+	key   string
+	owner string
+	ttl   time.Duration
+}
+
+type leaseMeta struct {
+	Key     string  `zed:"key"`
+	Owner   string  `zed:"owner"`
+	Expires nano.Ts `zed:"expires"`
+}
+
+// NewLease returns a lease on key in the pool of lake that, once acquired,
+// lasts for ttl unless renewed.
+func NewLease(lake *Lake, key string, ttl time.Duration) *Lease {
+	host, _ := os.Hostname()
+	return &Lease{
+		lake:  lake,
+		key:   key,
+		owner: fmt.Sprintf("%s:%d:%s", host, os.Getpid(), ksuid.New()),
+		ttl:   ttl,
+	}
+}
+
+func (l *Lease) String() string {
+	return fmt.Sprintf("lease %q on pool %s", l.key, l.lake.Pool())
+}
+
+// Acquire acquires the lease.  If another writer holds the lease, Acquire
+// returns ErrLeaseHeld or, if wait is true, waits for the lease to expire.
+func (l *Lease) Acquire(ctx context.Context, wait bool) error {
+	if err := etl.CreateBranch(ctx, l.lake.service, l.lake.poolID, LeaseBranch, ksuid.Nil); err != nil {
+		return err
+	}
+	for {
+		var expires time.Time
+		err := l.update(ctx, func(cur *leaseMeta) (*leaseMeta, error) {
+			if cur != nil && cur.Owner != l.owner && time.Until(cur.Expires.Time()) > 0 {
+				expires = cur.Expires.Time()
+				return nil, fmt.Errorf("%w: %s held by %s until %s", ErrLeaseHeld, l, cur.Owner, expires.Format(time.RFC3339))
+			}
+			return l.meta(time.Now().Add(l.ttl)), nil
+		})
+		if !wait || !errors.Is(err, ErrLeaseHeld) {
+			return err
+		}
+		fmt.Printf("%s, waiting\n", err)
+		if err := sleep(ctx, time.Until(expires)); err != nil {
+			return err
+		}
+	}
+}
+
+// Renew extends the lease by its TTL.  It returns ErrLeaseLost if another
+// writer has taken the lease over.
+func (l *Lease) Renew(ctx context.Context) error {
+	return l.update(ctx, func(cur *leaseMeta) (*leaseMeta, error) {
+		if cur == nil || cur.Owner != l.owner {
+			return nil, fmt.Errorf("%w: %s", ErrLeaseLost, l)
+		}
+		return l.meta(time.Now().Add(l.ttl)), nil
+	})
+}
+
+// Release gives the lease up if it is still held so another writer can
+// acquire it without waiting for it to expire.
+func (l *Lease) Release(ctx context.Context) error {
+	return l.update(ctx, func(cur *leaseMeta) (*leaseMeta, error) {
+		if cur == nil || cur.Owner != l.owner {
+			return cur, nil
+		}
+		return nil, nil
+	})
+}
+
+// keep renews the lease every third of its TTL until ctx is done.
+func (l *Lease) keep(ctx context.Context) error {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := l.Renew(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+func (l *Lease) meta(expires time.Time) *leaseMeta {
+	return &leaseMeta{Key: l.key, Owner: l.owner, Expires: nano.TimeToTs(expires)}
+}
+
+// update reads the leases of the pool, passes the lease for l.key, or nil if
+// there is none, to change, and commits the leases with that lease replaced
+// by the one change returns, or removed if change returns nil.  Leases that
+// have expired are dropped.  If another writer commits first, update starts
+// over as described for etl.RetryConflicts.
+func (l *Lease) update(ctx context.Context, change func(*leaseMeta) (*leaseMeta, error)) error {
+	return etl.RetryConflicts(ctx, func() error {
+		head, meta, err := etl.HeadMeta(ctx, l.lake.service, l.lake.poolID, LeaseBranch)
+		if err != nil {
+			return err
+		}
+		// Lease commits made by earlier versions of zync have no
+		// zync_leases field and are ignored.
+		var leases []leaseMeta
+		if val := meta.Deref("zync_leases"); val != nil && !val.IsNull() {
+			if err := zson.UnmarshalZNG(*val, &leases); err != nil {
+				return fmt.Errorf("%s: %w", LeaseBranch, err)
+			}
+		}
+		var cur *leaseMeta
+		var next []leaseMeta
+		for k, lease := range leases {
+			if lease.Key == l.key {
+				cur = &leases[k]
+			} else if time.Until(lease.Expires.Time()) > 0 {
+				next = append(next, lease)
+			}
+		}
+		lease, err := change(cur)
+		if err != nil || lease == cur {
+			return err
+		}
+		if lease != nil {
+			next = append(next, *lease)
+		}
+		zsonLeases, err := zson.Marshal(next)
+		if err != nil {
+			return err
+		}
+		message := api.CommitMessage{
+			Author: l.owner,
+			Body:   fmt.Sprintf("lease %s", l.key),
+			Meta:   fmt.Sprintf("{zync_leases:%s}", zsonLeases),
+		}
+		_, err = etl.ReplaceMeta(ctx, l.lake.service, l.lake.poolID, LeaseBranch, head, message)
+		return err
+	}, nil)
+}
+
+// Fence runs fn while holding leases, which must already be acquired.  The
+// leases are renewed in the background until fn returns.  If any lease is
+// lost, the context passed to fn is canceled and Fence returns an error
+// wrapping ErrLeaseLost.
+func Fence(ctx context.Context, leases []*Lease, fn func(context.Context) error) error {
+	group, groupCtx := errgroup.WithContext(ctx)
+	renewCtx, stopRenewing := context.WithCancel(groupCtx)
+	for _, l := range leases {
+		l := l
+		group.Go(func() error {
+			return l.keep(renewCtx)
+		})
+	}
+	group.Go(func() error {
+		defer stopRenewing()
+		return fn(groupCtx)
+	})
+	return group.Wait()
+}
+
+// ReleaseAll releases leases.  Errors are ignored since a lease that is not
+// released simply expires.
+func ReleaseAll(ctx context.Context, leases []*Lease) {
+	for _, l := range leases {
+		l.Release(ctx)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,105 @@
+package fifo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brimdata/zed"
+	lakeapi "github.com/brimdata/zed/lake/api"
+	"github.com/brimdata/zed/zbuf"
+	"github.com/brimdata/zed/zson"
+	"github.com/brimdata/zync/etl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestLake(t *testing.T) *Lake {
+	ctx := context.Background()
+	service, err := lakeapi.CreateLocalLake(ctx, zap.NewNop(), t.TempDir())
+	require.NoError(t, err)
+	_, err = etl.CreatePool(ctx, service, "test", "", 0)
+	require.NoError(t, err)
+	lk, err := NewLake(ctx, "test", "", service)
+	require.NoError(t, err)
+	return lk
+}
+
+func testBatch(t *testing.T, zctx *zed.Context, records ...string) *zbuf.Array {
+	var vals []zed.Value
+	for _, s := range records {
+		val, err := zson.ParseValue(zctx, s)
+		require.NoError(t, err)
+		vals = append(vals, val)
+	}
+	return zbuf.NewArray(vals)
+}
+
+func TestLeaseAcquireRenewRelease(t *testing.T) {
+	ctx := context.Background()
+	lk := newTestLake(t)
+	a := NewLease(lk, "from-kafka/t", time.Minute)
+	b := NewLease(lk, "from-kafka/t", time.Minute)
+	other := NewLease(lk, "from-kafka/u", time.Minute)
+	require.NoError(t, a.Acquire(ctx, false))
+	// Acquiring again renews the lease.
+	require.NoError(t, a.Acquire(ctx, false))
+	require.NoError(t, a.Renew(ctx))
+	assert.ErrorIs(t, b.Acquire(ctx, false), ErrLeaseHeld)
+	assert.ErrorIs(t, b.Renew(ctx), ErrLeaseLost)
+	// Leases on other keys are independent.
+	require.NoError(t, other.Acquire(ctx, false))
+	require.NoError(t, a.Renew(ctx))
+	// Releasing a lease that is not held leaves it alone.
+	require.NoError(t, b.Release(ctx))
+	assert.ErrorIs(t, b.Acquire(ctx, false), ErrLeaseHeld)
+	require.NoError(t, a.Release(ctx))
+	require.NoError(t, b.Acquire(ctx, false))
+	assert.ErrorIs(t, a.Renew(ctx), ErrLeaseLost)
+	require.NoError(t, other.Renew(ctx))
+}
+
+func TestLeaseTakeover(t *testing.T) {
+	ctx := context.Background()
+	lk := newTestLake(t)
+	a := NewLease(lk, "from-kafka/t", 50*time.Millisecond)
+	b := NewLease(lk, "from-kafka/t", time.Minute)
+	require.NoError(t, a.Acquire(ctx, false))
+	assert.ErrorIs(t, b.Acquire(ctx, false), ErrLeaseHeld)
+	// With wait, b acquires the lease once a lets it expire.
+	require.NoError(t, b.Acquire(ctx, true))
+	assert.ErrorIs(t, a.Renew(ctx), ErrLeaseLost)
+	assert.ErrorIs(t, a.Acquire(ctx, false), ErrLeaseHeld)
+}
+
+func TestRequireLease(t *testing.T) {
+	ctx := context.Background()
+	zctx := zed.NewContext()
+	a := NewLease(newTestLake(t), "from-kafka/t", 50*time.Millisecond)
+	require.NoError(t, a.Acquire(ctx, false))
+	lkA := a.lake
+	require.NoError(t, lkA.RequireLease(ctx, a))
+	_, n, err := lkA.LoadBatch(ctx, zctx, testBatch(t, zctx, `{kafka:{topic:"t",offset:0},value:0}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// A second writer takes the lease over after it expires and records
+	// itself as the holder in the pool's checkpoint.
+	lkB, err := NewLake(ctx, "test", "", lkA.service)
+	require.NoError(t, err)
+	b := NewLease(lkB, "from-kafka/t", time.Minute)
+	require.NoError(t, b.Acquire(ctx, true))
+	require.NoError(t, lkB.RequireLease(ctx, b))
+	_, n, err = lkB.LoadBatch(ctx, zctx, testBatch(t, zctx, `{kafka:{topic:"t",offset:1},value:1}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The first writer, yet to find out at its next renewal, cannot commit.
+	_, _, err = lkA.LoadBatch(ctx, zctx, testBatch(t, zctx, `{kafka:{topic:"t",offset:2},value:2}`))
+	assert.ErrorIs(t, err, ErrLeaseLost)
+	checkpoint, err := etl.LoadCheckpoint(ctx, lkB.service, lkB.poolID, lkB.head)
+	require.NoError(t, err)
+	assert.Equal(t, b.owner, checkpoint.Holder(b.key))
+	assert.Equal(t, int64(2), checkpoint.NextOffsets()["t"])
+}
@@ -0,0 +1,139 @@
+package fifo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/pkg/field"
+	"github.com/brimdata/zed/zson"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+)
+
+// PartitionField is the field of a record giving the partition to which
+// it is produced, as set by to-kafka's -partitionby.  It is namespaced so it
+// cannot collide with user data, and it is only honored by a Producer told
+// to with UsePartitionField.  The kafka.partition field is not used since
+// records synced from Kafka carry the partition of their source topic, which
+// has nothing to do with the target topic.
+const PartitionField = "zync.partition"
+
+// partition returns the partition to which rec, whose encoded key is key,
+// is produced.  If p uses PartitionField and rec has it, that is the
+// partition.  Otherwise, the partition is computed from key as Kafka's Java
+// client does by default, so records with the same key land in the same
+// partition no matter which client produced them.  Records with a null key
+// are spread over the partitions by their kafka.offset.  Partitions are
+// computed here rather than by the Kafka client so that they are the same
+// each time a record is produced, which syncing relies on.
+func (p *Producer) partition(ctx context.Context, rec zed.Value, key []byte) (int32, error) {
+	n, err := p.numPartitions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if val := rec.DerefPath(field.Dotted(PartitionField)); p.partitionField && val != nil && !val.IsNull() {
+		if !zed.IsInteger(val.Type().ID()) {
+			return 0, fmt.Errorf("%s is not an integer: %s", PartitionField, zson.FormatValue(*val))
+		}
+		partition := val.AsInt()
+		if partition < 0 || partition >= int64(n) {
+			return 0, fmt.Errorf("%s %d out of range for topic %s with %d partition%s", PartitionField, partition, p.topic, n, plural(int(n)))
+		}
+		return int32(partition), nil
+	}
+	if rec.Deref("key").MissingAsNull().IsNull() {
+		offset, _ := intField(rec, "kafka.offset")
+		return int32(offset % int64(n)), nil
+	}
+	return int32(murmur2(key)&0x7fffffff) % n, nil
+}
+
+// numPartitions returns the number of partitions in p's topic.  A topic that
+// does not yet exist is presumed to be created with a single partition
+// when it is first produced to.  The count is cached until refreshPartitions
+// finds it may be stale.
+func (p *Producer) numPartitions(ctx context.Context) (int32, error) {
+	if p.partitions > 0 {
+		return p.partitions, nil
+	}
+	details, err := kadm.NewClient(p.kclient).ListTopics(ctx, p.topic)
+	if err != nil {
+		return 0, err
+	}
+	p.partitions, p.presumed = 1, true
+	if detail, ok := details[p.topic]; ok {
+		if detail.Err != nil && !errors.Is(detail.Err, kerr.UnknownTopicOrPartition) {
+			return 0, detail.Err
+		}
+		if n := len(detail.Partitions); n > 0 {
+			p.partitions, p.presumed = int32(n), false
+		}
+	}
+	return p.partitions, nil
+}
+
+// refreshPartitions drops the cached partition count if it was presumed
+// because the topic did not exist or if a produce since the count was
+// cached reported a partition the client does not know, which happens when
+// partitions are added to the topic.
+func (p *Producer) refreshPartitions() {
+	p.mu.Lock()
+	stale := p.stale
+	p.stale = false
+	p.mu.Unlock()
+	if stale || p.presumed {
+		p.partitions, p.presumed = 0, false
+	}
+}
+
+// unknownPartition returns true if err, returned for a produced record,
+// means its partition is not one the client knows.
+func unknownPartition(err error) bool {
+	return errors.Is(err, kerr.UnknownTopicOrPartition) ||
+		strings.Contains(err.Error(), "invalid record partitioning choice")
+}
+
+func intField(rec zed.Value, path string) (int64, bool) {
+	val := rec.DerefPath(field.Dotted(path))
+	if val == nil || val.IsNull() || !zed.IsInteger(val.Type().ID()) {
+		return 0, false
+	}
+	return val.AsInt(), true
+}
+
+// murmur2 is the 32-bit MurmurHash2 variant used by Kafka's Java client to
+// partition records by key.
+func murmur2(b []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	h := seed ^ uint32(len(b))
+	for ; len(b) >= 4; b = b[4:] {
+		k := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch len(b) {
+	case 3:
+		h ^= uint32(b[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(b[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(b[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
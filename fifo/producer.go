@@ -3,6 +3,8 @@ package fifo
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
 
 	"github.com/brimdata/zed"
 	"github.com/brimdata/zed/zbuf"
@@ -12,12 +14,34 @@ import (
 	"github.com/riferrei/srclient"
 	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"golang.org/x/exp/slices"
 )
 
+// OffsetHeader is the Kafka record header in which a producer records the
+// kafka.offset of the pool record from which a Kafka record was produced.
+// Kafka offsets need not be contiguous (e.g., on topics written
+// transactionally, commit markers take up offsets), so this header
+// maps produced offsets back to pool offsets.
+const OffsetHeader = "zync.offset"
+
+// BatchHeader is the Kafka record header in which Producer.Send records the
+// kafka.offset of the first pool record of the batch being sent.
+const BatchHeader = "zync.batch"
+
 type Producer struct {
-	encode  func(zed.Value) ([]byte, error)
-	kclient *kgo.Client
-	topic   string
+	encode         func(zed.Value) ([]byte, error)
+	kclient        *kgo.Client
+	opts           []kgo.Opt
+	topic          string
+	transactional  bool
+	partitionField bool            // whether PartitionField gives the partition
+	partitions     int32           // number of partitions in topic or 0 if not known
+	presumed       bool            // partitions is presumed since topic does not exist
+	next           map[int32]int64 // next pool offset for each partition
+
+	mu    sync.Mutex
+	err   error // first produce error since the last flush
+	stale bool  // a produce reported an unknown partition
 }
 
 func NewProducer(opts []kgo.Opt, reg *srclient.SchemaRegistryClient, format, topic, namespace string) (*Producer, error) {
@@ -30,19 +54,194 @@ func NewProducer(opts []kgo.Opt, reg *srclient.SchemaRegistryClient, format, top
 	default:
 		return nil, fmt.Errorf("unknonwn format %q", format)
 	}
-	kclient, err := kgo.NewClient(opts...)
+	// Records are produced asynchronously.  The client's default
+	// idempotent producer preserves their order even with multiple
+	// requests in flight and retries, so we must not disable it.  The
+	// client bounds the records it buffers (by default, to 10000), so
+	// producing blocks rather than buffering without limit.
+	kclient, err := kgo.NewClient(append(slices.Clone(opts),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()))...)
 	if err != nil {
 		return nil, err
 	}
 	return &Producer{
 		encode:  encode,
 		kclient: kclient,
+		opts:    opts,
 		topic:   topic,
 	}, nil
 }
 
-func (p *Producer) HeadOffset(ctx context.Context) (int64, error) {
-	return maxOffset(kadm.NewClient(p.kclient).ListEndOffsets(ctx, p.topic))
+// NewTransactionalProducer returns a Producer whose Send commits each batch
+// atomically in a Kafka transaction.  The transactional ID is derived from
+// pool and topic so that when a new producer for the same pool and topic
+// starts, Kafka aborts any transaction left open by its predecessor and
+// fences the predecessor off from producing any more records.
+func NewTransactionalProducer(opts []kgo.Opt, reg *srclient.SchemaRegistryClient, format, pool, topic, namespace string) (*Producer, error) {
+	opts = append(slices.Clone(opts), kgo.TransactionalID(TransactionalID(pool, topic)))
+	p, err := NewProducer(opts, reg, format, topic, namespace)
+	if err != nil {
+		return nil, err
+	}
+	p.transactional = true
+	return p, nil
+}
+
+// UsePartitionField makes p produce each record with a PartitionField to the
+// partition it gives.
+func (p *Producer) UsePartitionField() {
+	p.partitionField = true
+}
+
+// TransactionalID returns the Kafka transactional ID used to sync pool
+// to topic.
+func TransactionalID(pool, topic string) string {
+	return fmt.Sprintf("zync-%s-%s", pool, topic)
+}
+
+// Resume returns the pool offset from which syncing to the topic resumes
+// and prepares p to skip records that were already produced.
+//
+// For each partition, the last record in the partition gives, in its
+// OffsetHeader, the pool offset of the last record produced to the
+// partition and, in its BatchHeader, the pool offset of the first record
+// in the batch that included it.  Since Send does not return until a
+// batch has been produced entirely, every batch before the latest batch in
+// any partition is known to be complete, so syncing resumes at the start
+// of that batch.  Records in the resumed range that were already produced
+// to their partition are skipped by Send.  For records produced without
+// an OffsetHeader (e.g., by an earlier version of zync), the Kafka offset
+// and pool offset are presumed to be the same.  Records produced without a
+// BatchHeader were produced one batch at a time in pool offset order, so
+// for them syncing resumes after the record itself.
+func (p *Producer) Resume(ctx context.Context) (int64, error) {
+	client := kadm.NewClient(p.kclient)
+	starts, err := client.ListStartOffsets(ctx, p.topic)
+	if err != nil {
+		return 0, err
+	}
+	if err := starts.Error(); err != nil {
+		return 0, err
+	}
+	// The last stable offset, unlike the high-water mark, never follows
+	// an undecided transaction.
+	ends, err := client.ListCommittedOffsets(ctx, p.topic)
+	if err != nil {
+		return 0, err
+	}
+	if err := ends.Error(); err != nil {
+		return 0, err
+	}
+	last := make(map[int32]*kgo.Record)
+	for partition, end := range ends[p.topic] {
+		start, _ := starts.Lookup(p.topic, partition)
+		rec, err := p.lastRecord(ctx, partition, start.Offset, end.Offset)
+		if err != nil {
+			return 0, err
+		}
+		if rec != nil {
+			last[partition] = rec
+		}
+	}
+	var resume int64
+	p.next, resume = resumeOffsets(last)
+	return resume, nil
+}
+
+// resumeOffsets returns, given the last record of each partition, the next
+// pool offset for each partition and the pool offset from which syncing
+// resumes as described for Resume.
+func resumeOffsets(last map[int32]*kgo.Record) (map[int32]int64, int64) {
+	next := make(map[int32]int64)
+	var resume int64
+	for partition, rec := range last {
+		offset, batch := recordOffsets(rec)
+		next[partition] = offset + 1
+		if batch < 0 {
+			batch = offset + 1
+		}
+		if batch > resume {
+			resume = batch
+		}
+	}
+	return next, resume
+}
+
+// lastRecord returns the last committed record in partition before end,
+// scanning backward from end in ever larger windows, or nil if there is
+// no such record after start.
+func (p *Producer) lastRecord(ctx context.Context, partition int32, start, end int64) (*kgo.Record, error) {
+	for window := int64(16); ; window *= 2 {
+		from := end - window
+		if from < start {
+			from = start
+		}
+		if from >= end {
+			return nil, nil
+		}
+		rec, err := p.lastRecordInRange(ctx, partition, from, end)
+		if rec != nil || err != nil || from == start {
+			return rec, err
+		}
+	}
+}
+
+// lastRecordInRange returns the last committed record in partition's offset
+// range [from, end) or nil if there are only control records in the range.
+func (p *Producer) lastRecordInRange(ctx context.Context, partition int32, from, end int64) (*kgo.Record, error) {
+	opts := append(slices.Clone(p.opts),
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{
+			p.topic: {partition: kgo.NewOffset().At(from)},
+		}),
+		// Control records are kept so that we see every offset up to
+		// end and know when to stop.  Aborted records are dropped.
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+		kgo.KeepControlRecords(),
+	)
+	kclient, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer kclient.Close()
+	var last *kgo.Record
+	for {
+		fetches := kclient.PollFetches(ctx)
+		for _, e := range fetches.Errors() {
+			return nil, fmt.Errorf("topic %s, partition %d: %w", e.Topic, e.Partition, e.Err)
+		}
+		for it := fetches.RecordIter(); !it.Done(); {
+			rec := it.Next()
+			if rec.Offset >= end {
+				return last, nil
+			}
+			if !rec.Attrs.IsControl() {
+				last = rec
+			}
+			if rec.Offset == end-1 {
+				return last, nil
+			}
+		}
+	}
+}
+
+// recordOffsets returns the pool offset from which rec was produced and the
+// pool offset of the first record of the batch in which it was produced or
+// -1 if rec has no BatchHeader.
+func recordOffsets(rec *kgo.Record) (int64, int64) {
+	offset, batch := rec.Offset, int64(-1)
+	for _, h := range rec.Headers {
+		n, err := strconv.ParseInt(string(h.Value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch h.Key {
+		case OffsetHeader:
+			offset = n
+		case BatchHeader:
+			batch = n
+		}
+	}
+	return offset, batch
 }
 
 func (p *Producer) Run(ctx context.Context, reader zio.Reader) error {
@@ -55,14 +254,14 @@ func (p *Producer) Run(ctx context.Context, reader zio.Reader) error {
 		if rec == nil || err != nil {
 			break
 		}
-		err = p.write(ctx, *rec)
+		err = p.write(ctx, *rec, nil)
 		if err != nil {
 			break
 		}
 		n++
 	}
 	fmt.Println("waiting for Kafka flush...")
-	if err2 := p.kclient.Flush(ctx); err == nil {
+	if err2 := p.flush(ctx); err == nil {
 		err = err2
 	}
 	fmt.Printf("%d messages produced to topic %q\n", n, p.topic)
@@ -70,16 +269,106 @@ func (p *Producer) Run(ctx context.Context, reader zio.Reader) error {
 	return err
 }
 
+// Send produces batch, which must be in kafka.offset order, to the topic
+// and waits for it to be flushed.  Records already produced to their
+// partition, as determined by Resume, are skipped.  If p is transactional,
+// either all of batch is committed or none of it is.
 func (p *Producer) Send(ctx context.Context, batch zbuf.Batch) error {
-	for _, rec := range batch.Values() {
-		if err := p.write(ctx, rec); err != nil {
+	vals := batch.Values()
+	if len(vals) == 0 {
+		return nil
+	}
+	var batchHeader *kgo.RecordHeader
+	if offset, ok := intField(vals[0], "kafka.offset"); ok {
+		batchHeader = &kgo.RecordHeader{
+			Key:   BatchHeader,
+			Value: []byte(strconv.FormatInt(offset, 10)),
+		}
+	}
+	p.refreshPartitions()
+	if p.transactional {
+		if err := p.kclient.BeginTransaction(); err != nil {
+			return err
+		}
+	}
+	for _, rec := range vals {
+		if err := p.write(ctx, rec, batchHeader); err != nil {
+			p.abort(ctx)
 			return err
 		}
 	}
-	return p.kclient.Flush(ctx)
+	if err := p.flush(ctx); err != nil {
+		p.abort(ctx)
+		return err
+	}
+	if p.transactional {
+		return p.kclient.EndTransaction(ctx, kgo.TryCommit)
+	}
+	return nil
+}
+
+// abort aborts the current transaction if p is transactional.  Errors are
+// ignored since the caller is already returning an error and since Kafka
+// aborts an unfinished transaction on its own after a timeout.
+func (p *Producer) abort(ctx context.Context) {
+	if p.transactional {
+		p.kclient.AbortBufferedRecords(ctx)
+		p.kclient.EndTransaction(ctx, kgo.TryAbort)
+	}
 }
 
-func (p *Producer) write(ctx context.Context, rec zed.Value) error {
+// flush waits for all records written since the last flush to be
+// acknowledged and returns the first error encountered producing any
+// of them.
+func (p *Producer) flush(ctx context.Context) error {
+	err := p.kclient.Flush(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		err = p.err
+		p.err = nil
+	}
+	return err
+}
+
+// promise records the first error returned by an asynchronous produce and
+// whether any produce reported an unknown partition.
+func (p *Producer) promise(_ *kgo.Record, err error) {
+	if err != nil {
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = err
+		}
+		if unknownPartition(err) {
+			p.stale = true
+		}
+		p.mu.Unlock()
+	}
+}
+
+// write produces rec asynchronously, adding batchHeader to the record's
+// headers if it is not nil.  It returns an error if rec cannot be encoded
+// or if an earlier write has failed.  Other errors are returned by the
+// next flush.
+func (p *Producer) write(ctx context.Context, rec zed.Value, batchHeader *kgo.RecordHeader) error {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	krec, err := p.record(ctx, rec, batchHeader)
+	if krec == nil || err != nil {
+		return err
+	}
+	p.kclient.Produce(ctx, krec, p.promise)
+	return nil
+}
+
+// record returns the Kafka record to produce for rec, adding batchHeader to
+// its headers if it is not nil, or nil if rec was already produced to its
+// partition.
+func (p *Producer) record(ctx context.Context, rec zed.Value, batchHeader *kgo.RecordHeader) (*kgo.Record, error) {
 	key := rec.Deref("key").MissingAsNull()
 	val := rec.Deref("value")
 	if val == nil {
@@ -87,15 +376,35 @@ func (p *Producer) write(ctx context.Context, rec zed.Value) error {
 	}
 	keyBytes, err := p.encode(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	valBytes, err := p.encode(*val)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return p.kclient.ProduceSync(ctx, &kgo.Record{
-		Key:   keyBytes,
-		Value: valBytes,
-		Topic: p.topic,
-	}).FirstErr()
+	partition, err := p.partition(ctx, rec, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	var headers []kgo.RecordHeader
+	if offset, ok := intField(rec, "kafka.offset"); ok {
+		if next, ok := p.next[partition]; ok && offset < next {
+			// Already produced to this partition.
+			return nil, nil
+		}
+		headers = append(headers, kgo.RecordHeader{
+			Key:   OffsetHeader,
+			Value: []byte(strconv.FormatInt(offset, 10)),
+		})
+	}
+	if batchHeader != nil {
+		headers = append(headers, *batchHeader)
+	}
+	return &kgo.Record{
+		Key:       keyBytes,
+		Value:     valBytes,
+		Headers:   headers,
+		Topic:     p.topic,
+		Partition: partition,
+	}, nil
 }
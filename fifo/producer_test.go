@@ -0,0 +1,125 @@
+package fifo
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/brimdata/zed"
+	"github.com/brimdata/zed/zson"
+	"github.com/brimdata/zync/connectjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func newTestProducer(partitions int32) *Producer {
+	return &Producer{encode: connectjson.Encode, topic: "t", partitions: partitions}
+}
+
+func parseRecord(t *testing.T, s string) zed.Value {
+	val, err := zson.ParseValue(zed.NewContext(), s)
+	require.NoError(t, err)
+	return val
+}
+
+func kafkaRecord(offset int64, headers map[string]int64) *kgo.Record {
+	rec := &kgo.Record{Offset: offset}
+	for k, v := range headers {
+		rec.Headers = append(rec.Headers, kgo.RecordHeader{Key: k, Value: []byte(strconv.FormatInt(v, 10))})
+	}
+	return rec
+}
+
+func TestResumeOffsets(t *testing.T) {
+	next, resume := resumeOffsets(nil)
+	assert.Empty(t, next)
+	assert.Equal(t, int64(0), resume)
+
+	next, resume = resumeOffsets(map[int32]*kgo.Record{
+		// Last record of the latest batch, which started at pool
+		// offset 20.
+		0: kafkaRecord(7, map[string]int64{OffsetHeader: 24, BatchHeader: 20}),
+		// Last record of an earlier batch.
+		1: kafkaRecord(5, map[string]int64{OffsetHeader: 12, BatchHeader: 10}),
+		// Produced without a batch header, one batch at a time.
+		2: kafkaRecord(3, map[string]int64{OffsetHeader: 17}),
+	})
+	assert.Equal(t, map[int32]int64{0: 25, 1: 13, 2: 18}, next)
+	assert.Equal(t, int64(20), resume)
+
+	// Without an offset header, the Kafka offset is the pool offset.
+	next, resume = resumeOffsets(map[int32]*kgo.Record{0: kafkaRecord(30, nil)})
+	assert.Equal(t, map[int32]int64{0: 31}, next)
+	assert.Equal(t, int64(31), resume)
+}
+
+func TestPartition(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProducer(4)
+	rec := parseRecord(t, `{key:"foobar",value:1,zync:{partition:3},kafka:{topic:"t",offset:9,partition:2}}`)
+	// Without UsePartitionField, zync.partition and kafka.partition are
+	// ignored and the partition is computed from the key.
+	partition, err := p.partition(ctx, rec, []byte("foobar"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(murmur2([]byte("foobar"))&0x7fffffff)%4, partition)
+
+	p.UsePartitionField()
+	partition, err = p.partition(ctx, rec, []byte("foobar"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), partition)
+
+	_, err = p.partition(ctx, parseRecord(t, `{key:"a",zync:{partition:4}}`), []byte("a"))
+	assert.ErrorContains(t, err, "zync.partition 4 out of range for topic t with 4 partitions")
+	_, err = p.partition(ctx, parseRecord(t, `{key:"a",zync:{partition:"x"}}`), []byte("a"))
+	assert.ErrorContains(t, err, "zync.partition is not an integer")
+
+	// Records with a null key are spread by kafka.offset.
+	partition, err = p.partition(ctx, parseRecord(t, `{key:null,value:1,kafka:{offset:9}}`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), partition)
+}
+
+func TestRefreshPartitions(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProducer(4)
+	p.refreshPartitions()
+	// The cached count is used without asking Kafka.
+	n, err := p.numPartitions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), n)
+
+	p.promise(nil, kerr.UnknownTopicOrPartition)
+	p.refreshPartitions()
+	assert.Equal(t, int32(0), p.partitions)
+
+	p.partitions, p.presumed = 1, true
+	p.refreshPartitions()
+	assert.Equal(t, int32(0), p.partitions)
+	assert.False(t, p.presumed)
+}
+
+func TestRecordSkipsProduced(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProducer(2)
+	p.next = map[int32]int64{0: 10}
+	// Records with a null key land in partition kafka.offset%2.
+	krec, err := p.record(ctx, parseRecord(t, `{key:null,value:1,kafka:{offset:8}}`), nil)
+	require.NoError(t, err)
+	assert.Nil(t, krec, "already produced to partition 0")
+	// Partition 1 has no record, so nothing is skipped there.
+	krec, err = p.record(ctx, parseRecord(t, `{key:null,value:1,kafka:{offset:9}}`), nil)
+	require.NoError(t, err)
+	require.NotNil(t, krec)
+	assert.Equal(t, int32(1), krec.Partition)
+	batch := &kgo.RecordHeader{Key: BatchHeader, Value: []byte("10")}
+	krec, err = p.record(ctx, parseRecord(t, `{key:null,value:1,kafka:{offset:10}}`), batch)
+	require.NoError(t, err)
+	require.NotNil(t, krec)
+	assert.Equal(t, int32(0), krec.Partition)
+	assert.Equal(t, "t", krec.Topic)
+	offset, batchOffset := recordOffsets(krec)
+	assert.Equal(t, int64(10), offset)
+	assert.Equal(t, int64(10), batchOffset)
+}
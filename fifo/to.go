@@ -6,11 +6,15 @@ import (
 
 	"github.com/brimdata/zed"
 	"github.com/brimdata/zed/zbuf"
+	"github.com/brimdata/zync/etl"
+	"github.com/segmentio/ksuid"
 )
 
 // To provides a means to sync from a Zed data pool to a Kafka topic in a
-// consistent and crash-recoverable fashion.  The data synced to the topic
-// has the same offset as the kafka.offset field in the records in the pool.
+// consistent and crash-recoverable fashion.  Each record synced to the topic
+// carries the kafka.offset field of its pool record in the OffsetHeader
+// header so syncing can resume where it left off even when the offsets in
+// the pool or in the topic are not contiguous.
 type To struct {
 	zctx  *zed.Context
 	dst   *Producer
@@ -26,32 +30,121 @@ func NewTo(zctx *zed.Context, dst *Producer, src *Lake) *To {
 	}
 }
 
+// BatchSize is the number of records in each batch that Sync sends.  Since a
+// restarted Sync resends at most the latest batch, batches are kept small,
+// and the cost of a lake query and a Kafka flush per batch is hidden by
+// reading each batch while the one before it is sent.
 const BatchSize = 200
 
-func (t *To) Sync(ctx context.Context) error {
-	offset, err := t.dst.HeadOffset(ctx)
+// readResult is a batch read by To.read or the error that ended reading.
+type readResult struct {
+	batch  zbuf.Batch // empty when the topic has caught up with the pool
+	offset int64      // offset from which batch was read
+	err    error
+}
+
+// Sync syncs records from the pool to the topic until the topic has caught
+// up with the pool.  If follow is true, Sync then waits for new commits to
+// the pool and syncs their records as they arrive.  Sync returns nil when
+// ctx is done, but only between batches, so a batch being sent when ctx is
+// done is sent in its entirety.
+func (t *To) Sync(ctx context.Context, follow bool) error {
+	offset, err := t.dst.Resume(ctx)
 	if err != nil {
 		return err
 	}
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan readResult)
+	go t.read(readCtx, offset, follow, results)
+	for r := range results {
+		if r.err != nil {
+			return ignoreDone(ctx, r.err)
+		}
+		n := len(r.batch.Values())
+		if n == 0 {
+			fmt.Printf("topic %s reached sync at offset %d\n", t.dst.topic, r.offset)
+			continue
+		}
+		if err := t.dst.Send(context.WithoutCancel(ctx), r.batch); err != nil {
+			return err
+		}
+		fmt.Printf("topic %s committed %d record%s at offset %d\n", t.dst.topic, n, plural(n), r.offset)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// read reads batches of records from the pool starting at offset and sends
+// them to results, which it closes when done, until the topic has caught up
+// with the pool.  It then sends an empty batch and, if follow is true, waits
+// for new commits to the pool and goes on reading.  read stops at the first
+// error, which it sends to results, or when ctx is done.
+func (t *To) read(ctx context.Context, offset int64, follow bool, results chan<- readResult) {
+	defer close(results)
+	send := func(r readResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 	for {
+		var head ksuid.KSUID
+		if follow {
+			// Note the head before querying so that a commit made
+			// after the query will end the wait below.
+			var err error
+			head, err = t.src.Head(ctx)
+			if err != nil {
+				send(readResult{err: err})
+				return
+			}
+		}
 		// Query of batch of records that start at the given offset.
 		batch, err := t.src.ReadBatch(ctx, t.dst.topic, offset, BatchSize)
 		if err != nil {
-			return err
+			send(readResult{err: err})
+			return
 		}
-		batchLen := len(batch.Values())
-		if batchLen == 0 {
-			fmt.Printf("reached sync at offset %d\n", offset)
-			//XXX should pause and poll again... for now, exit
-			break
+		if !send(readResult{batch: batch, offset: offset}) {
+			return
 		}
-		if err := t.dst.Send(ctx, batch); err != nil {
-			return err
+		vals := batch.Values()
+		if len(vals) == 0 {
+			if !follow {
+				return
+			}
+			if _, err := t.src.WaitForCommit(ctx, head); err != nil {
+				send(readResult{err: err})
+				return
+			}
+			continue
+		}
+		// Offsets in the pool may have gaps (e.g., when the pool was
+		// synced from a compacted topic), so we continue after the
+		// last offset in the batch rather than adding its length.
+		last, err := etl.Field(vals[len(vals)-1], "kafka")
+		if err == nil {
+			offset, err = etl.FieldAsInt(last, "offset")
 		}
-		fmt.Printf("committed %d record%s at offset %d to output topic\n", batchLen, plural(batchLen), offset)
-		offset += int64(batchLen)
+		if err != nil {
+			send(readResult{err: err})
+			return
+		}
+		offset++
 	}
-	return nil
+}
+
+// ignoreDone returns nil if ctx is done and err otherwise.
+func ignoreDone(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
 }
 
 func plural(n int) string {